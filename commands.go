@@ -0,0 +1,338 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// A subcommand, run as `fsconsul <name> [options]`.  It returns the process
+// exit code.
+type command func(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int
+
+var commands = map[string]command{
+	"encrypt":      encryptCommand,
+	"encrypt-file": encryptFileCommand,
+	"decrypt":      decryptCommand,
+	"rekey":        rekeyCommand,
+}
+
+// Builds the flag set for a subcommand, reporting errors on stderr.
+func commandFlags(name string, usage string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: fsconsul %s\n\nOptions:\n\n", usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// Reads the input of a subcommand from the named file, or stdin without one.
+func readInput(flags *flag.FlagSet, stdin io.Reader) ([]byte, error) {
+	if flags.NArg() > 0 {
+		return ioutil.ReadFile(flags.Arg(0))
+	}
+	return ioutil.ReadAll(stdin)
+}
+
+// Encrypts a plaintext and prints the goDecrypt tag that decrypts it.
+func encryptCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	var keystore string
+	var keyName string
+	var authData string
+
+	flags := commandFlags("encrypt", "encrypt [options] [file]", stderr)
+	flags.StringVar(
+		&keystore, "keystore", "",
+		"directory of keys used for encryption")
+	flags.StringVar(
+		&keyName, "keyName", "",
+		"name of the key in the keystore to encrypt with")
+	flags.StringVar(
+		&authData, "authData", "",
+		"additional data bound to the value, which must match when it is decrypted")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if keystore == "" || keyName == "" {
+		flags.Usage()
+		return 1
+	}
+
+	plaintext, err := readInput(flags, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read plaintext: %v\n", err)
+		return 2
+	}
+
+	// Whatever produced the plaintext most likely ended it with a newline
+	// that isn't part of the secret.
+	tag, err := goEncryptFunc(keystore)(authData, strings.TrimSuffix(string(plaintext), "\n"), keyName)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to encrypt: %v\n", err)
+		return 2
+	}
+
+	fmt.Fprintln(stdout, tag)
+	return 0
+}
+
+// Matches a goEncrypt marker and captures its quoted arguments.
+var goEncryptMarker = regexp.MustCompile(`\{\{\s*goEncrypt((?:\s+"(?:[^"\\]|\\.)*")+)\s*\}\}`)
+var quotedArgument = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// Unquotes the arguments a goEncrypt marker or goDecrypt tag captured.
+func unquoteArguments(quoted []byte) ([]string, error) {
+	var args []string
+	for _, q := range quotedArgument.FindAllString(string(quoted), -1) {
+		arg, err := strconv.Unquote(q)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid argument %s", q)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// Replaces every {{goEncrypt "authData" "plaintext" "keyName"}} marker in a
+// template with the goDecrypt tag for it, leaving the rest of the template as
+// it is.
+func encryptMarkers(content []byte, keystore string) ([]byte, error) {
+	encrypt := goEncryptFunc(keystore)
+
+	var firstErr error
+	encrypted := goEncryptMarker.ReplaceAllFunc(content, func(marker []byte) []byte {
+		args, err := unquoteArguments(goEncryptMarker.FindSubmatch(marker)[1])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Could not encrypt %s: %v", marker, err)
+			}
+			return marker
+		}
+
+		tag, err := encrypt(args...)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Could not encrypt %s: %v", marker, err)
+			}
+			return marker
+		}
+		return []byte(tag)
+	})
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return encrypted, nil
+}
+
+// Rewrites the goEncrypt markers in a template into goDecrypt tags.
+func encryptFileCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	var keystore string
+	var inPlace bool
+
+	flags := commandFlags("encrypt-file", "encrypt-file [options] [file]", stderr)
+	flags.StringVar(
+		&keystore, "keystore", "",
+		"directory of keys used for encryption")
+	flags.BoolVar(
+		&inPlace, "w", false,
+		"write the result back to the file instead of printing it")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if keystore == "" || (inPlace && flags.NArg() == 0) {
+		flags.Usage()
+		return 1
+	}
+
+	content, err := readInput(flags, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read template: %v\n", err)
+		return 2
+	}
+
+	encrypted, err := encryptMarkers(content, keystore)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if inPlace {
+		if err := writeFileAtomic(flags.Arg(0), encrypted); err != nil {
+			fmt.Fprintf(stderr, "Failed to write template: %v\n", err)
+			return 2
+		}
+		return 0
+	}
+
+	stdout.Write(encrypted)
+	return 0
+}
+
+// Matches a goDecrypt tag and captures its quoted arguments.
+var goDecryptTag = regexp.MustCompile(`\{\{\s*goDecrypt((?:\s+"(?:[^"\\]|\\.)*")+)\s*\}\}`)
+
+// Matches a [gosecret|authData|cipherText|initVector|keyName] tag and captures
+// its fields.
+var gosecretTag = regexp.MustCompile(`\[gosecret\|([^\]]*)\]`)
+
+// Returns the names of the keys the encrypted tags in a value need, sorted.
+func referencedKeyNames(content []byte) []string {
+	seen := make(map[string]bool)
+	for _, match := range goDecryptTag.FindAllSubmatch(content, -1) {
+		quoted := quotedArgument.FindAllString(string(match[1]), -1)
+		if name, err := strconv.Unquote(quoted[len(quoted)-1]); err == nil {
+			seen[name] = true
+		}
+	}
+	for _, match := range gosecretTag.FindAllSubmatch(content, -1) {
+		fields := strings.Split(string(match[1]), "|")
+		seen[fields[len(fields)-1]] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Adds the flags for reaching Consul to a subcommand.  Anything they leave
+// out comes from the standard CONSUL_* environment variables.
+func consulFlags(flags *flag.FlagSet, consulConfig *ConsulConfig) {
+	flags.StringVar(
+		&consulConfig.Addr, "addr", "",
+		"consul HTTP API address with port")
+	flags.StringVar(
+		&consulConfig.DC, "dc", "",
+		"consul datacenter, uses local if blank")
+	flags.StringVar(
+		&consulConfig.Token, "token", "",
+		"token to use for ACL access")
+	flags.StringVar(
+		&consulConfig.TokenFile, "tokenFile", "",
+		"file holding the token to use for ACL access")
+}
+
+// Reads a single key from Consul.
+func readConsulKey(consulConfig ConsulConfig, key string) ([]byte, error) {
+	config := WatchConfig{Consul: consulConfig}
+	applyDefaults(&config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		return nil, err
+	}
+
+	result, _, err := runQuery(client, key, kvGetQuery(key), newTokenSource(config.Consul), consulapi.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	pair, _ := result.(*consulapi.KVPair)
+	if pair == nil {
+		return nil, fmt.Errorf("Key not found: %s", key)
+	}
+	return pair.Value, nil
+}
+
+// Decrypts a value the way a mapping with the same keys would and prints it,
+// reporting which keystore keys it needs and which of those are missing.
+func decryptCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	var keystore string
+	var ageIdentities string
+	var pgpKeyring string
+	var pgpPassphraseFile string
+	var key string
+	var consulConfig ConsulConfig
+
+	flags := commandFlags("decrypt", "decrypt [options] [file]", stderr)
+	flags.StringVar(
+		&keystore, "keystore", "",
+		"directories of keys used for decryption, pipe-delimited and searched in order")
+	flags.StringVar(
+		&ageIdentities, "ageIdentities", "",
+		"pipe-delimited files of age identities used for decryption")
+	flags.StringVar(
+		&pgpKeyring, "pgpKeyring", "",
+		"pipe-delimited files of armored OpenPGP secret keys used for decryption")
+	flags.StringVar(
+		&pgpPassphraseFile, "pgpPassphraseFile", "",
+		"file holding the passphrase that unlocks the OpenPGP keys")
+	flags.StringVar(
+		&key, "key", "",
+		"consul key to read the value from, instead of a file or stdin")
+	consulFlags(flags, &consulConfig)
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	mappingConfig := &MappingConfig{
+		Keystore:          parseKeystoreDirs(keystore),
+		AgeIdentities:     splitList(ageIdentities),
+		PGPKeyring:        splitList(pgpKeyring),
+		PGPPassphraseFile: pgpPassphraseFile,
+	}
+	if !decryptsValues(mappingConfig) {
+		flags.Usage()
+		return 1
+	}
+
+	var value []byte
+	var err error
+	if key != "" {
+		value, err = readConsulKey(consulConfig, key)
+	} else {
+		value, err = readInput(flags, stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read value: %v\n", err)
+		return 2
+	}
+
+	names := referencedKeyNames(value)
+	missing := newKeyChain(mappingConfig).missing(names)
+	if len(names) == 0 {
+		fmt.Fprintln(stderr, "Keys referenced: none")
+	} else {
+		fmt.Fprintf(stderr, "Keys referenced: %s\n", strings.Join(names, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stderr, "Keys missing from keystore: %s\n", strings.Join(missing, ", "))
+	}
+
+	plaintext, err := decryptValue(mappingConfig, string(value))
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to decrypt value: %v\n", err)
+		return 2
+	}
+
+	stdout.Write(plaintext)
+	return 0
+}
+
+// Runs the subcommand named by the first argument, if there is one.
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return 0, false
+	}
+
+	// Subcommands report their own errors, so keep the log to warnings.
+	log.SetLevel(log.WarnLevel)
+	return cmd(args[1:], os.Stdin, os.Stdout, os.Stderr), true
+}
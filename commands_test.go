@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testKeystore = "test_data/ks"
+
+// Decrypts the goDecrypt tags in a value the way a mapping would.
+func decryptForTest(t *testing.T, value string) string {
+	decrypted, err := decryptValue(&MappingConfig{Keystore: KeystoreDirs{testKeystore}}, value)
+	if err != nil {
+		t.Fatalf("Could not decrypt %q: %v", value, err)
+	}
+	return string(decrypted)
+}
+
+func TestEncryptCommand(t *testing.T) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	args := []string{"-keystore", testKeystore, "-keyName", "fsconsul_test_key", "-authData", "db.password"}
+
+	code := encryptCommand(args, strings.NewReader("hunter2\n"), stdout, stderr)
+	if code != 0 {
+		t.Fatalf("Expected success, got %d: %s", code, stderr)
+	}
+
+	tag := strings.TrimSpace(stdout.String())
+	if !strings.HasPrefix(tag, `{{goDecrypt "db.password" `) {
+		t.Fatalf("Unexpected tag %q", tag)
+	}
+	if plaintext := decryptForTest(t, tag); plaintext != "hunter2" {
+		t.Fatalf("Expected hunter2, got %q", plaintext)
+	}
+
+	// Auth data with quotes and backslashes still makes a tag that parses.
+	stdout.Reset()
+	args = []string{"-keystore", testKeystore, "-keyName", "fsconsul_test_key", "-authData", `db "password" \ 1`}
+	if code := encryptCommand(args, strings.NewReader("hunter2\n"), stdout, stderr); code != 0 {
+		t.Fatalf("Expected success, got %d: %s", code, stderr)
+	}
+	tag = strings.TrimSpace(stdout.String())
+	if plaintext := decryptForTest(t, tag); plaintext != "hunter2" {
+		t.Fatalf("Expected hunter2, got %q", plaintext)
+	}
+	if names := referencedKeyNames([]byte(tag)); len(names) != 1 || names[0] != "fsconsul_test_key" {
+		t.Fatalf("Unexpected key names %v in %q", names, tag)
+	}
+
+	// A key that isn't in the keystore is an error.
+	args = []string{"-keystore", testKeystore, "-keyName", "missing"}
+	if code := encryptCommand(args, strings.NewReader("x"), new(bytes.Buffer), new(bytes.Buffer)); code == 0 {
+		t.Fatalf("Expected a failure for a missing key")
+	}
+
+	// As is leaving out the key name.
+	if code := encryptCommand([]string{"-keystore", testKeystore}, strings.NewReader("x"), new(bytes.Buffer), new(bytes.Buffer)); code != 1 {
+		t.Fatalf("Expected a usage error, got %d", code)
+	}
+}
+
+func TestEncryptFileCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul-encrypt")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := "user=app\npassword={{ goEncrypt \"db \\\"password\\\" \\\\ 1\" \"hunter \\\"2\\\"\" \"fsconsul_test_key\" }}\nhost={{key \"db/host\"}}\n"
+	file := path.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(file, []byte(template), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stderr := new(bytes.Buffer)
+	code := encryptFileCommand([]string{"-keystore", testKeystore, "-w", file}, nil, new(bytes.Buffer), stderr)
+	if code != 0 {
+		t.Fatalf("Expected success, got %d: %s", code, stderr)
+	}
+
+	encrypted, _ := ioutil.ReadFile(file)
+	if strings.Contains(string(encrypted), "goEncrypt") || !strings.Contains(string(encrypted), `host={{key "db/host"}}`) {
+		t.Fatalf("Unexpected template %q", encrypted)
+	}
+
+	// Decrypting just the secret gives back what was there.
+	lines := strings.Split(string(encrypted), "\n")
+	password := strings.TrimPrefix(lines[1], "password=")
+	if plaintext := decryptForTest(t, password); plaintext != `hunter "2"` {
+		t.Fatalf("Expected hunter \"2\", got %q", plaintext)
+	}
+}
+
+func TestEncryptMarkersInvalidEscape(t *testing.T) {
+	// An argument Go can't unquote is an error, not an empty string.
+	marker := `{{goEncrypt "auth" "\q" "fsconsul_test_key"}}`
+	if _, err := encryptMarkers([]byte(marker), testKeystore); err == nil {
+		t.Fatalf("Expected an error for an invalid escape")
+	}
+}
+
+func TestDecryptCommand(t *testing.T) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	code := decryptCommand([]string{"-keystore", testKeystore, "test_data/encrypted_file"}, nil, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("Expected success, got %d: %s", code, stderr)
+	}
+
+	expected, _ := ioutil.ReadFile("test_data/decrypted_file")
+	if stdout.String() != string(expected) {
+		t.Fatalf("Expected %q, got %q", expected, stdout)
+	}
+	if !strings.Contains(stderr.String(), "Keys referenced: fsconsul_test_key\n") {
+		t.Fatalf("Unexpected report %q", stderr)
+	}
+}
+
+func TestDecryptCommandMissingKey(t *testing.T) {
+	value := `{{goDecrypt "a" "b" "c" "fsconsul_test_key"}} [gosecret|a|b|c|retired_key]`
+
+	stderr := new(bytes.Buffer)
+	code := decryptCommand([]string{"-keystore", testKeystore}, strings.NewReader(value), new(bytes.Buffer), stderr)
+	if code == 0 {
+		t.Fatalf("Expected a failure")
+	}
+
+	report := stderr.String()
+	if !strings.Contains(report, "Keys referenced: fsconsul_test_key, retired_key\n") ||
+		!strings.Contains(report, "Keys missing from keystore: retired_key\n") {
+		t.Fatalf("Unexpected report %q", report)
+	}
+}
+
+func TestDecryptCommandFromConsul(t *testing.T) {
+	encrypted, _ := ioutil.ReadFile("test_data/encrypted_file")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/app/config" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `[{"Key": "app/config", "Value": "%s"}]`, base64.StdEncoding.EncodeToString(encrypted))
+	}))
+	defer server.Close()
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	args := []string{"-keystore", testKeystore, "-addr", server.Listener.Addr().String(), "-key", "app/config"}
+	if code := decryptCommand(args, nil, stdout, stderr); code != 0 {
+		t.Fatalf("Expected success, got %d: %s", code, stderr)
+	}
+
+	expected, _ := ioutil.ReadFile("test_data/decrypted_file")
+	if stdout.String() != string(expected) {
+		t.Fatalf("Expected %q, got %q", expected, stdout)
+	}
+
+	args = []string{"-keystore", testKeystore, "-addr", server.Listener.Addr().String(), "-key", "app/missing"}
+	if code := decryptCommand(args, nil, new(bytes.Buffer), new(bytes.Buffer)); code == 0 {
+		t.Fatalf("Expected a failure for a missing key")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// Ways a mapping can decrypt its values.
+const (
+	decryptionGosecret = "gosecret"
+	decryptionAge      = "age"
+	decryptionOpenPGP  = "openpgp"
+	decryptionEnvelope = "envelope"
+)
+
+// Headers that mark a whole value as encrypted.
+const (
+	ageBinaryHeader  = "age-encryption.org/v1\n"
+	pgpMessageHeader = "-----BEGIN PGP MESSAGE-----"
+)
+
+// decryptor turns a value read from Consul into the plaintext to write.
+type decryptor interface {
+	decrypt(value []byte) ([]byte, error)
+}
+
+// Reports whether a mapping has any keys to decrypt its values with.
+func decryptsValues(mappingConfig *MappingConfig) bool {
+	return len(mappingConfig.Keystore) > 0 || len(mappingConfig.AgeIdentities) > 0 ||
+		len(mappingConfig.PGPKeyring) > 0 || mappingConfig.KMS != nil
+}
+
+// Picks the decryptor for a value: the one the mapping asks for, or else the
+// one whose header the value starts with.  Values without a header can hold
+// gosecret tags when there is a keystore, and are otherwise left alone, in
+// which case the decryptor is nil.
+func selectDecryptor(mappingConfig *MappingConfig, value []byte) (decryptor, error) {
+	decryption := mappingConfig.Decryption
+	if decryption == "" {
+		decryption = detectDecryption(mappingConfig, value)
+	}
+
+	switch decryption {
+	case "":
+		return nil, nil
+	case decryptionGosecret:
+		return &gosecretDecryptor{keys: newKeyChain(mappingConfig), goDecrypt: true}, nil
+	case decryptionAge:
+		return keyFiles.load(decryptionAge, mappingConfig.AgeIdentities, func() (decryptor, error) {
+			return newAgeDecryptor(mappingConfig.AgeIdentities)
+		})
+	case decryptionOpenPGP:
+		files := mappingConfig.PGPKeyring
+		if mappingConfig.PGPPassphraseFile != "" {
+			files = append(files[:len(files):len(files)], mappingConfig.PGPPassphraseFile)
+		}
+		return keyFiles.load(decryptionOpenPGP, files, func() (decryptor, error) {
+			return newOpenPGPDecryptor(mappingConfig.PGPKeyring, mappingConfig.PGPPassphraseFile)
+		})
+	case decryptionEnvelope:
+		if mappingConfig.KMS == nil {
+			return nil, fmt.Errorf("No KMS to decrypt envelopes with")
+		}
+		return &envelopeDecryptor{mappingConfig.KMS}, nil
+	}
+	return nil, fmt.Errorf("Unknown decryption: %s", decryption)
+}
+
+// Works out how a value was encrypted from its header, considering only the
+// kinds of key the mapping has.
+func detectDecryption(mappingConfig *MappingConfig, value []byte) string {
+	trimmed := bytes.TrimLeft(value, " \t\r\n")
+	switch {
+	case len(mappingConfig.AgeIdentities) > 0 &&
+		(bytes.HasPrefix(trimmed, []byte(agearmor.Header)) || bytes.HasPrefix(value, []byte(ageBinaryHeader))):
+		return decryptionAge
+	case len(mappingConfig.PGPKeyring) > 0 && bytes.HasPrefix(trimmed, []byte(pgpMessageHeader)):
+		return decryptionOpenPGP
+	case mappingConfig.KMS != nil && isEnvelope(value):
+		return decryptionEnvelope
+	case len(mappingConfig.Keystore) > 0:
+		return decryptionGosecret
+	}
+	return ""
+}
+
+// keyFileCache holds the decryptors built from key files, so that the files
+// are only read, and their keys unlocked, again once one of them changes.
+type keyFileCache struct {
+	lock    sync.Mutex
+	entries map[string]cachedDecryptor
+}
+
+type cachedDecryptor struct {
+	files     []os.FileInfo
+	decryptor decryptor
+}
+
+var keyFiles = &keyFileCache{entries: make(map[string]cachedDecryptor)}
+
+// Returns the decryptor last built from the files, or builds it again when
+// one of them has changed since.
+func (c *keyFileCache) load(kind string, files []string, build func() (decryptor, error)) (decryptor, error) {
+	id := kind + "\x00" + strings.Join(files, "\x00")
+
+	var infos []os.FileInfo
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			return build()
+		}
+		infos = append(infos, info)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cached, ok := c.entries[id]; ok && sameFiles(cached.files, infos) {
+		return cached.decryptor, nil
+	}
+
+	d, err := build()
+	if err != nil {
+		return nil, err
+	}
+	c.entries[id] = cachedDecryptor{infos, d}
+	return d, nil
+}
+
+func sameFiles(a []os.FileInfo, b []os.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].ModTime().Equal(b[i].ModTime()) || a[i].Size() != b[i].Size() {
+			return false
+		}
+	}
+	return true
+}
+
+// gosecretDecryptor decrypts the gosecret tags in a value with the keys in the
+// mapping's keystore.
+type gosecretDecryptor struct {
+	keys *keyChain
+
+	// goDecrypt replaces {{goDecrypt ...}} tags too.  Key templates leave
+	// them to their own render.
+	goDecrypt bool
+}
+
+// The tags are found and replaced rather than the value being run as a
+// template, since whoever can write to Consul shouldn't get to run one.
+func (d *gosecretDecryptor) decrypt(value []byte) ([]byte, error) {
+	decrypted, err := d.keys.decryptTags(value)
+	if err != nil || !d.goDecrypt {
+		return decrypted, err
+	}
+	return d.keys.decryptGoDecryptTags(decrypted)
+}
+
+// ageDecryptor decrypts values encrypted with age, armored or not, using
+// X25519 identities.
+type ageDecryptor struct {
+	identities []age.Identity
+}
+
+// Reads the identities from files in the format age-keygen writes.
+func newAgeDecryptor(files []string) (*ageDecryptor, error) {
+	var identities []age.Identity
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read age identities from %s: %v", name, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("No age identities to decrypt with")
+	}
+	return &ageDecryptor{identities}, nil
+}
+
+func (d *ageDecryptor) decrypt(value []byte) ([]byte, error) {
+	var src io.Reader = bytes.NewReader(value)
+	if !bytes.HasPrefix(value, []byte(ageBinaryHeader)) {
+		src = agearmor.NewReader(src)
+	}
+
+	plaintext, err := age.Decrypt(src, d.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plaintext)
+}
+
+// openPGPDecryptor decrypts ASCII-armored OpenPGP messages with the secret
+// keys in a keyring.  Signatures on the messages aren't checked.
+type openPGPDecryptor struct {
+	keyring openpgp.EntityList
+}
+
+// Reads armored secret keys from files, unlocking them with the passphrase in
+// passphraseFile if there is one.
+func newOpenPGPDecryptor(files []string, passphraseFile string) (*openPGPDecryptor, error) {
+	var passphrase []byte
+	if passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(data, "\r\n")
+	}
+
+	var keyring openpgp.EntityList
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read OpenPGP keys from %s: %v", name, err)
+		}
+
+		if passphrase != nil {
+			for _, entity := range entities {
+				if err := entity.DecryptPrivateKeys(passphrase); err != nil {
+					return nil, fmt.Errorf("Could not unlock OpenPGP keys from %s: %v", name, err)
+				}
+			}
+		}
+		keyring = append(keyring, entities...)
+	}
+
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("No OpenPGP keys to decrypt with")
+	}
+	return &openPGPDecryptor{keyring}, nil
+}
+
+func (d *openPGPDecryptor) decrypt(value []byte) ([]byte, error) {
+	block, err := pgparmor.Decode(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PGP MESSAGE" {
+		return nil, fmt.Errorf("Expected a PGP MESSAGE, got a %s", block.Type)
+	}
+
+	message, err := openpgp.ReadMessage(block.Body, d.keyring, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(message.UnverifiedBody)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// Writes a new age identity to a file and returns it.
+func writeAgeIdentity(t *testing.T, dir string) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	content := "# created: for a test\n" + identity.String() + "\n"
+	if err := ioutil.WriteFile(path.Join(dir, "age.key"), []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return identity
+}
+
+func ageEncrypt(t *testing.T, recipient age.Recipient, plaintext string, armored bool) string {
+	buff := new(bytes.Buffer)
+	var dst io.WriteCloser = nopCloser{buff}
+	if armored {
+		dst = agearmor.NewWriter(buff)
+	}
+
+	w, err := age.Encrypt(dst, recipient)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.Write([]byte(plaintext))
+	w.Close()
+	dst.Close()
+	return buff.String()
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Writes a new OpenPGP key to a file, locked with the passphrase if there is
+// one, and returns it.
+func writePGPKey(t *testing.T, dir string, passphrase string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("fsconsul", "test", "fsconsul@example.com", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	keyBuff := new(bytes.Buffer)
+	if passphrase != "" {
+		if err := entity.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	w, _ := pgparmor.Encode(keyBuff, openpgp.PrivateKeyType, nil)
+	if err := entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.Close()
+
+	if err := ioutil.WriteFile(path.Join(dir, "pgp.asc"), keyBuff.Bytes(), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return entity
+}
+
+func pgpEncrypt(t *testing.T, entity *openpgp.Entity, plaintext string) string {
+	buff := new(bytes.Buffer)
+	armored, _ := pgparmor.Encode(buff, "PGP MESSAGE", nil)
+	w, err := openpgp.Encrypt(armored, []*openpgp.Entity{entity}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.Write([]byte(plaintext))
+	w.Close()
+	armored.Close()
+	return buff.String()
+}
+
+func TestDecryptors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fsconsul-decrypt")
+	defer os.RemoveAll(dir)
+
+	identity := writeAgeIdentity(t, dir)
+	entity := writePGPKey(t, dir, "")
+	gosecretValue, _ := ioutil.ReadFile("test_data/encrypted_file")
+	gosecretPlaintext, _ := ioutil.ReadFile("test_data/decrypted_file")
+
+	// Each value is decrypted according to its header.
+	mapping := &MappingConfig{
+		Keystore:      KeystoreDirs{testKeystore},
+		AgeIdentities: []string{path.Join(dir, "age.key")},
+		PGPKeyring:    []string{path.Join(dir, "pgp.asc")},
+	}
+	values := map[string]string{
+		ageEncrypt(t, identity.Recipient(), "armored age", true): "armored age",
+		ageEncrypt(t, identity.Recipient(), "binary age", false): "binary age",
+		"\n" + pgpEncrypt(t, entity, "pgp {{ not a template }}"): "pgp {{ not a template }}",
+		string(gosecretValue): string(gosecretPlaintext),
+		"plain value":         "plain value",
+	}
+	for value, expected := range values {
+		decrypted, err := decryptValue(mapping, value)
+		if err != nil {
+			t.Fatalf("Could not decrypt %q: %v", value, err)
+		}
+		if string(decrypted) != expected {
+			t.Fatalf("Expected %q, got %q", expected, decrypted)
+		}
+	}
+
+	// Without a keystore, values without a header are left alone.
+	ageOnly := &MappingConfig{AgeIdentities: mapping.AgeIdentities}
+	if decrypted, _ := decryptValue(ageOnly, "{{ plain }}"); string(decrypted) != "{{ plain }}" {
+		t.Fatalf("Expected the value to be left alone, got %q", decrypted)
+	}
+
+	// A mapping that picks a decryption applies it to every value.
+	pgpOnly := &MappingConfig{Decryption: decryptionOpenPGP, PGPKeyring: mapping.PGPKeyring}
+	if _, err := decryptValue(pgpOnly, "plain value"); err == nil {
+		t.Fatalf("Expected an error for a value that isn't a PGP message")
+	}
+
+	// A value encrypted for someone else fails.
+	other, _ := age.GenerateX25519Identity()
+	if _, err := decryptValue(mapping, ageEncrypt(t, other.Recipient(), "secret", true)); err == nil {
+		t.Fatalf("Expected an error for a value encrypted to another identity")
+	}
+}
+
+func TestOpenPGPPassphrase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fsconsul-decrypt")
+	defer os.RemoveAll(dir)
+
+	entity := writePGPKey(t, dir, "correct horse")
+	value := pgpEncrypt(t, entity, "secret")
+	ioutil.WriteFile(path.Join(dir, "passphrase"), []byte("correct horse\n"), 0600)
+
+	mapping := &MappingConfig{PGPKeyring: []string{path.Join(dir, "pgp.asc")}}
+	if _, err := decryptValue(mapping, value); err == nil {
+		t.Fatalf("Expected an error decrypting with a locked key")
+	}
+
+	mapping.PGPPassphraseFile = path.Join(dir, "passphrase")
+	decrypted, err := decryptValue(mapping, value)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(decrypted) != "secret" {
+		t.Fatalf("Expected secret, got %q", decrypted)
+	}
+
+	ioutil.WriteFile(path.Join(dir, "passphrase"), []byte("wrong"), 0600)
+	if _, err := decryptValue(mapping, value); err == nil || !strings.Contains(err.Error(), "Could not unlock") {
+		t.Fatalf("Expected an error unlocking with the wrong passphrase, got %v", err)
+	}
+}
+
+func TestDecryptorsAreReused(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fsconsul-decrypt")
+	defer os.RemoveAll(dir)
+
+	writePGPKey(t, dir, "correct horse")
+	ioutil.WriteFile(path.Join(dir, "passphrase"), []byte("correct horse"), 0600)
+	mapping := &MappingConfig{
+		PGPKeyring:        []string{path.Join(dir, "pgp.asc")},
+		PGPPassphraseFile: path.Join(dir, "passphrase"),
+	}
+	value := []byte(pgpMessageHeader)
+
+	// The keyring is read and unlocked once, not for every value.
+	first, err := selectDecryptor(mapping, value)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if second, _ := selectDecryptor(mapping, value); second != first {
+		t.Fatalf("Expected the decryptor to be reused")
+	}
+
+	// Until the keyring changes.
+	entity := writePGPKey(t, dir, "correct horse")
+	third, err := selectDecryptor(mapping, value)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if third == first {
+		t.Fatalf("Expected the decryptor to be built again")
+	}
+	decrypted, err := third.decrypt([]byte(pgpEncrypt(t, entity, "secret")))
+	if err != nil || string(decrypted) != "secret" {
+		t.Fatalf("Expected secret, got %q %v", decrypted, err)
+	}
+}
+
+func TestDecryptionDecryptsOnlyTags(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fsconsul-decrypt")
+	defer os.RemoveAll(dir)
+
+	tag, err := goEncryptFunc(testKeystore)("auth", "hunter2", "fsconsul_test_key")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	os.Setenv("FSCONSUL_PROBE_SECRET", "leaked")
+	defer os.Unsetenv("FSCONSUL_PROBE_SECRET")
+
+	mapping := &MappingConfig{
+		Path:     path.Join(dir, "app.json"),
+		Keystore: KeystoreDirs{testKeystore},
+	}
+	env := map[string]string{
+		"a": "a {{ b",
+		"b": `{{ env "FSCONSUL_PROBE_SECRET" }}`,
+		"c": "c=" + tag,
+	}
+	expected := map[string]string{
+		"a": "a {{ b",
+		"b": `{{ env "FSCONSUL_PROBE_SECRET" }}`,
+		"c": "c=hunter2",
+	}
+
+	// Files written per key hold the values as they are, apart from the tags.
+	for k, v := range env {
+		content, err := keyContent(mapping, nil, k, v)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(content) != expected[k] {
+			t.Fatalf("Expected %q, got %q", expected[k], content)
+		}
+	}
+
+	// As do formatted files.
+	mapping.Format = outputFormatJSON
+	if _, err := (&formatFile{mapping: mapping}).render(env); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, _ := ioutil.ReadFile(mapping.Path)
+	want, _ := renderFormat(outputFormatJSON, "", expected)
+	if string(data) != string(want) {
+		t.Fatalf("Expected %q, got %q", want, data)
+	}
+
+	// A goDecrypt tag that can't be decrypted fails the value.
+	if _, err := decryptValue(mapping, `{{goDecrypt "a" "b" "c" "missing_key"}}`); err == nil {
+		t.Fatalf("Expected an error for a missing key")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIs an envelope decryption endpoint can speak.
+const (
+	kmsAPIAWS   = "aws"
+	kmsAPIVault = "vault"
+)
+
+// How long unwrapped data keys are kept when a mapping doesn't say.
+const defaultDataKeyTTL = 5 * time.Minute
+
+const kmsTimeout = 10 * time.Second
+
+// KMSConfig describes a local endpoint that unwraps the data keys of
+// envelope-encrypted values.  Requests to it aren't signed, so it is meant
+// for a sidecar or agent that handles authentication itself.
+type KMSConfig struct {
+	// Addr is the endpoint's URL.
+	Addr string
+
+	// API is "aws" (the default) for the AWS KMS Decrypt API, or "vault" for
+	// Vault's transit engine mounted at Mount ("transit" by default).
+	API   string
+	Mount string
+
+	// KeyID is sent to AWS KMS as the KeyId, or names the Vault transit key.
+	// A value can only name a different key of its own when AllowValueKeyID
+	// is set, since whoever writes it would otherwise pick the key.
+	KeyID           string
+	AllowValueKeyID bool
+
+	// Token, or the contents of TokenFile, is sent to Vault as its token.
+	Token     string
+	TokenFile string
+
+	// CacheTTL is how long an unwrapped data key is kept in memory, e.g.
+	// "30s".  It is five minutes by default, and "0s" turns caching off.
+	CacheTTL string
+}
+
+// Checks a mapping's KMS settings before any value needs them.
+func validateKMSConfig(kms *KMSConfig) error {
+	if kms.Addr == "" {
+		return fmt.Errorf("KMS needs an Addr")
+	}
+	switch kms.API {
+	case "", kmsAPIAWS, kmsAPIVault:
+	default:
+		return fmt.Errorf("Unknown KMS API: %s", kms.API)
+	}
+	_, err := dataKeyTTL(kms)
+	return err
+}
+
+func dataKeyTTL(kms *KMSConfig) (time.Duration, error) {
+	if kms.CacheTTL == "" {
+		return defaultDataKeyTTL, nil
+	}
+	ttl, err := time.ParseDuration(kms.CacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid KMS CacheTTL %s: %v", kms.CacheTTL, err)
+	}
+	return ttl, nil
+}
+
+// envelope is an envelope-encrypted value: the plaintext encrypted with
+// AES-GCM under a data key, and that data key as wrapped by the KMS.  In
+// Consul it is a JSON object, with Nonce and Ciphertext in base64.
+type envelope struct {
+	KeyID      string
+	WrappedKey string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func isEnvelope(value []byte) bool {
+	_, ok := parseEnvelope(value)
+	return ok
+}
+
+// Parses a value as an envelope, reporting whether it is one.
+func parseEnvelope(value []byte) (*envelope, bool) {
+	if !bytes.HasPrefix(bytes.TrimLeft(value, " \t\r\n"), []byte("{")) {
+		return nil, false
+	}
+
+	var env envelope
+	if err := json.Unmarshal(value, &env); err != nil || env.WrappedKey == "" || len(env.Ciphertext) == 0 {
+		return nil, false
+	}
+	return &env, true
+}
+
+// envelopeDecryptor decrypts envelopes, asking the KMS to unwrap their data
+// keys.
+type envelopeDecryptor struct {
+	kms *KMSConfig
+}
+
+func (d *envelopeDecryptor) decrypt(value []byte) ([]byte, error) {
+	env, ok := parseEnvelope(value)
+	if !ok {
+		return nil, fmt.Errorf("Value is not an envelope")
+	}
+
+	keyID := d.kms.KeyID
+	if env.KeyID != "" && env.KeyID != keyID {
+		if !d.kms.AllowValueKeyID {
+			return nil, fmt.Errorf("Envelope names key %s, which the mapping doesn't allow", env.KeyID)
+		}
+		keyID = env.KeyID
+	}
+	key, err := unwrapDataKey(d.kms, keyID, env.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Envelope nonce is %d bytes, expected %d", len(env.Nonce), aead.NonceSize())
+	}
+	return aead.Open(nil, env.Nonce, env.Ciphertext, nil)
+}
+
+// dataKeyCache holds unwrapped data keys until they expire, so that values
+// sharing a data key need only one request to the KMS.
+type dataKeyCache struct {
+	lock    sync.Mutex
+	entries map[string]cachedDataKey
+}
+
+type cachedDataKey struct {
+	key     []byte
+	expires time.Time
+}
+
+var dataKeys = &dataKeyCache{entries: make(map[string]cachedDataKey)}
+
+func (c *dataKeyCache) get(id string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	return entry.key, true
+}
+
+// Stores a key, dropping any that have expired.
+func (c *dataKeyCache) put(id string, key []byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for other, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, other)
+		}
+	}
+	c.entries[id] = cachedDataKey{key, now.Add(ttl)}
+}
+
+// Returns the plaintext of a wrapped data key, from the cache if it is there
+// and otherwise from the KMS.
+func unwrapDataKey(kms *KMSConfig, keyID string, wrappedKey string) ([]byte, error) {
+	ttl, err := dataKeyTTL(kms)
+	if err != nil {
+		return nil, err
+	}
+
+	id := strings.Join([]string{kms.API, kms.Addr, kms.Mount, keyID, wrappedKey}, "\x00")
+	if key, ok := dataKeys.get(id); ok {
+		return key, nil
+	}
+
+	var key []byte
+	switch kms.API {
+	case "", kmsAPIAWS:
+		key, err = awsKMSDecrypt(kms, keyID, wrappedKey)
+	case kmsAPIVault:
+		key, err = vaultTransitDecrypt(kms, keyID, wrappedKey)
+	default:
+		err = fmt.Errorf("Unknown KMS API: %s", kms.API)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		dataKeys.put(id, key, ttl)
+	}
+	return key, nil
+}
+
+// Unwraps a data key with the AWS KMS Decrypt API.  The wrapped key is the
+// base64 CiphertextBlob.
+func awsKMSDecrypt(kms *KMSConfig, keyID string, wrappedKey string) ([]byte, error) {
+	request := map[string]string{"CiphertextBlob": wrappedKey}
+	if keyID != "" {
+		request["KeyId"] = keyID
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", kms.Addr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+
+	var result struct {
+		Plaintext []byte
+	}
+	if err := kmsRequest(req, &result); err != nil {
+		return nil, err
+	}
+	return result.Plaintext, nil
+}
+
+// Unwraps a data key with Vault's transit engine.  The wrapped key is the
+// "vault:v1:..." ciphertext.
+func vaultTransitDecrypt(kms *KMSConfig, keyID string, wrappedKey string) ([]byte, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("Vault transit needs a KeyID")
+	}
+	if strings.Contains(keyID, "/") {
+		return nil, fmt.Errorf("Invalid Vault transit key: %s", keyID)
+	}
+	mount := kms.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+
+	body, err := json.Marshal(map[string]string{"ciphertext": wrappedKey})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimSuffix(kms.Addr, "/") + "/v1/" + strings.Trim(mount, "/") + "/decrypt/" + url.PathEscape(keyID)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	token := kms.Token
+	if kms.TokenFile != "" {
+		data, err := ioutil.ReadFile(kms.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	var result struct {
+		Data struct {
+			Plaintext string
+		}
+	}
+	if err := kmsRequest(req, &result); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.Data.Plaintext)
+}
+
+// Sends a request to the KMS and decodes its JSON response.
+func kmsRequest(req *http.Request, result interface{}) error {
+	client := &http.Client{Timeout: kmsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("KMS returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, result)
+}
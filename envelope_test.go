@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKMS stands in for a KMS, unwrapping the data keys it knows and counting
+// how often it is asked to.
+type fakeKMS struct {
+	lock     sync.Mutex
+	keys     map[string][]byte
+	requests int
+}
+
+func (kms *fakeKMS) unwrap(wrappedKey string) ([]byte, bool) {
+	kms.lock.Lock()
+	defer kms.lock.Unlock()
+	kms.requests++
+	key, ok := kms.keys[wrappedKey]
+	return key, ok
+}
+
+func (kms *fakeKMS) count() int {
+	kms.lock.Lock()
+	defer kms.lock.Unlock()
+	return kms.requests
+}
+
+// Answers the AWS KMS Decrypt API.
+func (kms *fakeKMS) serveAWS(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" {
+		http.Error(w, `{"__type": "UnknownOperationException"}`, http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		CiphertextBlob string
+		KeyId          string
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	key, ok := kms.unwrap(request.KeyId + "/" + request.CiphertextBlob)
+	if !ok {
+		http.Error(w, `{"__type": "InvalidCiphertextException"}`, http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": request.KeyId, "Plaintext": key})
+}
+
+// Answers Vault's transit decrypt endpoint, mounted at /v1/transit.
+func (kms *fakeKMS) serveVault(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "vault-token" {
+		http.Error(w, `{"errors": ["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Ciphertext string
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	key, ok := kms.unwrap(strings.TrimPrefix(r.URL.Path, "/v1/transit/decrypt/") + "/" + request.Ciphertext)
+	if !ok {
+		http.Error(w, `{"errors": ["invalid ciphertext"]}`, http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, `{"data": {"plaintext": %q}}`, base64.StdEncoding.EncodeToString(key))
+}
+
+// Encrypts a value under a new data key, which the KMS unwraps for the given
+// key ID and wrapped key.
+func sealEnvelope(t *testing.T, kms *fakeKMS, keyID string, wrappedKey string, plaintext string) string {
+	key := make([]byte, 32)
+	nonce := make([]byte, 12)
+	rand.Read(key)
+	rand.Read(nonce)
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	kms.lock.Lock()
+	kms.keys[keyID+"/"+wrappedKey] = key
+	kms.lock.Unlock()
+
+	data, err := json.Marshal(envelope{
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, []byte(plaintext), nil),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(data)
+}
+
+// Names the key an envelope was wrapped with in the envelope itself.
+func withKeyID(t *testing.T, value string, keyID string) string {
+	var env envelope
+	json.Unmarshal([]byte(value), &env)
+	env.KeyID = keyID
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(data)
+}
+
+func TestEnvelopeAWS(t *testing.T) {
+	kms := &fakeKMS{keys: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(kms.serveAWS))
+	defer server.Close()
+
+	mapping := &MappingConfig{
+		KMS: &KMSConfig{Addr: server.URL, KeyID: "alias/app1"},
+	}
+	first := sealEnvelope(t, kms, "alias/app1", "AQIDwrapped1", "first secret")
+	second := sealEnvelope(t, kms, "alias/app1", "AQIDwrapped2", "second secret")
+	values := map[string]string{
+		first:                        "first secret",
+		second:                       "second secret",
+		`{"not": "an envelope"}`:     `{"not": "an envelope"}`,
+		"{{ not decrypted either }}": "{{ not decrypted either }}",
+	}
+	for i := 0; i < 2; i++ {
+		for value, expected := range values {
+			decrypted, err := decryptValue(mapping, value)
+			if err != nil {
+				t.Fatalf("Could not decrypt %q: %v", value, err)
+			}
+			if string(decrypted) != expected {
+				t.Fatalf("Expected %q, got %q", expected, decrypted)
+			}
+		}
+	}
+
+	// Each data key is only unwrapped once.
+	if n := kms.count(); n != 2 {
+		t.Fatalf("Expected 2 requests to the KMS, got %d", n)
+	}
+
+	unknown := sealEnvelope(t, kms, "alias/other", "AQIDwrapped3", "secret")
+	if _, err := decryptValue(mapping, unknown); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Fatalf("Expected the KMS error, got %v", err)
+	}
+}
+
+func TestEnvelopeVault(t *testing.T) {
+	kms := &fakeKMS{keys: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(kms.serveVault))
+	defer server.Close()
+
+	tokenFile, _ := ioutil.TempFile("", "fsconsul-vault-token")
+	tokenFile.WriteString("vault-token\n")
+	tokenFile.Close()
+	defer os.Remove(tokenFile.Name())
+
+	mapping := &MappingConfig{
+		Decryption: decryptionEnvelope,
+		KMS: &KMSConfig{
+			Addr:      server.URL,
+			API:       kmsAPIVault,
+			KeyID:     "app1",
+			TokenFile: tokenFile.Name(),
+			CacheTTL:  "50ms",
+		},
+	}
+	if err := validateKMSConfig(mapping.KMS); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	value := sealEnvelope(t, kms, "app1", "vault:v1:wrapped", "vault secret")
+	for i := 0; i < 2; i++ {
+		decrypted, err := decryptValue(mapping, value)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(decrypted) != "vault secret" {
+			t.Fatalf("Expected vault secret, got %q", decrypted)
+		}
+	}
+	if n := kms.count(); n != 1 {
+		t.Fatalf("Expected 1 request to the KMS, got %d", n)
+	}
+
+	// Once the data key expires it is unwrapped again.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := decryptValue(mapping, value); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := kms.count(); n != 2 {
+		t.Fatalf("Expected 2 requests to the KMS, got %d", n)
+	}
+
+	// With envelope decryption forced, other values fail.
+	if _, err := decryptValue(mapping, "plain value"); err == nil {
+		t.Fatalf("Expected an error for a value that isn't an envelope")
+	}
+
+	mapping.KMS.Token = "wrong"
+	mapping.KMS.TokenFile = ""
+	value = sealEnvelope(t, kms, "app1", "vault:v1:other", "vault secret")
+	if _, err := decryptValue(mapping, value); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("Expected the Vault error, got %v", err)
+	}
+}
+
+func TestEnvelopeValueKeyID(t *testing.T) {
+	kms := &fakeKMS{keys: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(kms.serveVault))
+	defer server.Close()
+
+	mapping := &MappingConfig{
+		KMS: &KMSConfig{Addr: server.URL, API: kmsAPIVault, KeyID: "app1", Token: "vault-token", CacheTTL: "0s"},
+	}
+	other := withKeyID(t, sealEnvelope(t, kms, "app2", "vault:v1:app2", "app2 secret"), "app2")
+
+	// A value can't pick another key unless the mapping allows it.
+	if _, err := decryptValue(mapping, other); err == nil {
+		t.Fatalf("Expected an error for a value naming another key")
+	}
+	mapping.KMS.AllowValueKeyID = true
+	decrypted, err := decryptValue(mapping, other)
+	if err != nil || string(decrypted) != "app2 secret" {
+		t.Fatalf("Expected app2 secret, got %q %v", decrypted, err)
+	}
+
+	// Even then, it can't name a key outside the transit mount.
+	escaping := withKeyID(t, sealEnvelope(t, kms, "app1", "vault:v1:app1", "secret"), "../../sys/policy/x")
+	requests := kms.count()
+	if _, err := decryptValue(mapping, escaping); err == nil || !strings.Contains(err.Error(), "Invalid Vault transit key") {
+		t.Fatalf("Expected an invalid key error, got %v", err)
+	}
+	if kms.count() != requests {
+		t.Fatalf("Expected no request to Vault")
+	}
+}
+
+func TestValidateKMSConfig(t *testing.T) {
+	for _, kms := range []*KMSConfig{
+		{},
+		{Addr: "http://127.0.0.1:8200", API: "gcp"},
+		{Addr: "http://127.0.0.1:8200", CacheTTL: "forever"},
+	} {
+		if err := validateKMSConfig(kms); err == nil {
+			t.Fatalf("Expected an error for %+v", kms)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// externalKeys looks up keys outside a mapping's prefixes for its templates.
+// Each key or directory is read once and then watched, so later renders are
+// served from the cache and the mapping hears when any of them change.
+type externalKeys struct {
+	clients   []*consulapi.Client
+	tokens    *tokenSource
+	changedCh chan struct{}
+	quitCh    chan struct{}
+
+	lock   sync.Mutex
+	values map[string]map[string]string
+}
+
+func newExternalKeys(clients []*consulapi.Client, consulConfig ConsulConfig) *externalKeys {
+	return &externalKeys{
+		clients:   clients,
+		tokens:    newTokenSource(consulConfig),
+		changedCh: make(chan struct{}, 1),
+		quitCh:    make(chan struct{}),
+		values:    make(map[string]map[string]string),
+	}
+}
+
+// Reads a single key.  The result holds the key and its value, or nothing if
+// the key doesn't exist.
+func (e *externalKeys) key(name string) (map[string]string, error) {
+	return e.lookup("key:"+name, name, kvGetQuery(name), func(result interface{}) map[string]string {
+		values := make(map[string]string)
+		if pair, ok := result.(*consulapi.KVPair); ok && pair != nil {
+			values[pair.Key] = string(pair.Value)
+		}
+		return values
+	})
+}
+
+// Reads every key under a directory, by full key.
+func (e *externalKeys) tree(dir string) (map[string]string, error) {
+	return e.lookup("tree:"+dir, dir, kvListQuery(dir), func(result interface{}) map[string]string {
+		values := make(map[string]string)
+		if pairs, ok := result.(consulapi.KVPairs); ok {
+			for _, pair := range pairs {
+				values[pair.Key] = string(pair.Value)
+			}
+		}
+		return values
+	})
+}
+
+// Returns the cached values for a lookup, starting a watch for it the first
+// time it is asked for.
+func (e *externalKeys) lookup(id string, name string, query consulQuery, convert func(interface{}) map[string]string) (map[string]string, error) {
+	if values, ok := e.cached(id); ok {
+		return values, nil
+	}
+
+	resultCh := make(chan interface{})
+	errCh := make(chan error, 1)
+	go watch(e.clients, name, query, e.tokens, resultCh, errCh, e.quitCh)
+
+	select {
+	case result := <-resultCh:
+		values := convert(result)
+		e.lock.Lock()
+		e.values[id] = values
+		e.lock.Unlock()
+
+		go e.follow(id, resultCh, convert)
+		return values, nil
+	case err := <-errCh:
+		return nil, err
+	}
+}
+
+// Keeps the cache up to date with a watch, and tells the mapping when the
+// values change.
+func (e *externalKeys) follow(id string, resultCh <-chan interface{}, convert func(interface{}) map[string]string) {
+	for {
+		select {
+		case result := <-resultCh:
+			values := convert(result)
+
+			e.lock.Lock()
+			changed := !reflect.DeepEqual(e.values[id], values)
+			e.values[id] = values
+			e.lock.Unlock()
+
+			if changed {
+				select {
+				case e.changedCh <- struct{}{}:
+				default:
+				}
+			}
+		case <-e.quitCh:
+			return
+		}
+	}
+}
+
+func (e *externalKeys) cached(id string) (map[string]string, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	values, ok := e.values[id]
+	return values, ok
+}
+
+// Reports whether any of the lookups a render made have changed since.
+func (e *externalKeys) changedSince(seen map[string]map[string]string) bool {
+	for id, values := range seen {
+		if current, _ := e.cached(id); !reflect.DeepEqual(current, values) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops every watch.
+func (e *externalKeys) close() {
+	close(e.quitCh)
+}
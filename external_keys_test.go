@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeKV serves a single key, holding blocking queries until it changes.
+type fakeKV struct {
+	lock    sync.Mutex
+	value   string
+	index   int
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+func (kv *fakeKV) set(value string) {
+	kv.lock.Lock()
+	kv.value = value
+	kv.index++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+	kv.lock.Unlock()
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/kv/shared/db_host" {
+		http.NotFound(w, r)
+		return
+	}
+
+	kv.lock.Lock()
+	changed := kv.changed
+	index := kv.index
+	kv.lock.Unlock()
+
+	if r.URL.Query().Get("index") == fmt.Sprint(index) {
+		select {
+		case <-changed:
+		case <-kv.stop:
+		}
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	w.Header().Set("X-Consul-Index", fmt.Sprint(kv.index))
+	fmt.Fprintf(w, `[{"Key": "shared/db_host", "Value": "%s"}]`, base64.StdEncoding.EncodeToString([]byte(kv.value)))
+}
+
+func TestExternalKeys(t *testing.T) {
+	kv := &fakeKV{value: "db1", index: 1, changed: make(chan struct{}), stop: make(chan struct{})}
+	server := httptest.NewServer(kv)
+	defer server.Close()
+	defer close(kv.stop)
+
+	consulConfig := ConsulConfig{Addr: server.Listener.Addr().String()}
+	client, err := buildConsulClient(consulConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	external := newExternalKeys([]*consulapi.Client{client}, consulConfig)
+	defer external.close()
+
+	dir, err := ioutil.TempDir("", "fsconsul-external")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath := path.Join(dir, "app.tmpl")
+	ioutil.WriteFile(templatePath, []byte(`host={{key "shared/db_host"}} port={{keyOrDefault "shared/db_port" "5432"}}`), 0644)
+
+	mappingConfig := &MappingConfig{Path: path.Join(dir, "app.conf"), Template: templatePath}
+	renderer, err := newTemplateFile(mappingConfig, external)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	env := map[string]string{}
+	if changed, err := renderer.render(env); err != nil || !changed {
+		t.Fatalf("Expected a render, got %v %v", changed, err)
+	}
+	if data, _ := ioutil.ReadFile(mappingConfig.Path); string(data) != "host=db1 port=5432" {
+		t.Fatalf("Unexpected output %q", data)
+	}
+
+	// Nothing has changed, so there's nothing to render.
+	if changed, err := renderer.render(env); err != nil || changed {
+		t.Fatalf("Expected no render, got %v %v", changed, err)
+	}
+
+	// A change to the referenced key is picked up by its watch.
+	kv.set("db2")
+	select {
+	case <-external.changedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the change")
+	}
+	if changed, err := renderer.render(env); err != nil || !changed {
+		t.Fatalf("Expected a render, got %v %v", changed, err)
+	}
+	if data, _ := ioutil.ReadFile(mappingConfig.Path); string(data) != "host=db2 port=5432" {
+		t.Fatalf("Unexpected output %q", data)
+	}
+
+	// A key under the mapping's own prefix takes precedence.
+	env = map[string]string{"shared/db_host": "local"}
+	if changed, err := renderer.render(env); err != nil || !changed {
+		t.Fatalf("Expected a render, got %v %v", changed, err)
+	}
+	if data, _ := ioutil.ReadFile(mappingConfig.Path); string(data) != "host=local port=5432" {
+		t.Fatalf("Unexpected output %q", data)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	mappingConfig := &MappingConfig{KeyTemplates: true}
+	env := map[string]string{
+		"a.tmpl":    `a({{include "b.tmpl"}})`,
+		"b.tmpl":    `b({{include "c"}})`,
+		"c":         `c`,
+		"loop.tmpl": `{{include "b2"}}`,
+		"b2":        `{{include "loop.tmpl"}}`,
+	}
+	data := newKeyTemplateData(mappingConfig, env, nil, nil)
+
+	out, err := renderKeyTemplate(mappingConfig, data, "a.tmpl", env["a.tmpl"])
+	if err != nil || string(out) != "a(b(c))" {
+		t.Fatalf("Expected a(b(c)), got %q %v", out, err)
+	}
+
+	_, err = renderKeyTemplate(mappingConfig, data, "loop.tmpl", env["loop.tmpl"])
+	if err == nil || !strings.Contains(err.Error(), "Template cycle: loop.tmpl -> b2 -> loop.tmpl") {
+		t.Fatalf("Expected a cycle error, got %v", err)
+	}
+}
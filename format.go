@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Structured files a mapping can serialise its keys into.
+const (
+	outputFormatJSON       = "json"
+	outputFormatYAML       = "yaml"
+	outputFormatTOML       = "toml"
+	outputFormatDotenv     = "dotenv"
+	outputFormatProperties = "properties"
+	outputFormatINI        = "ini"
+)
+
+// keyTree is a mapping's keys nested by "/".  Each entry is either a string
+// value or another keyTree.
+type keyTree map[string]interface{}
+
+// Nests keys by "/".  Folder keys, which end in "/", carry no value and are
+// skipped.  With a value format, each value is parsed and its document takes
+// the key's place in the tree.
+func buildKeyTree(env map[string]string, valueFormat string) (keyTree, error) {
+	tree := make(keyTree)
+	for k, v := range env {
+		if k == "" || strings.HasSuffix(k, "/") {
+			continue
+		}
+
+		parts := strings.Split(k, "/")
+		node := tree
+		for _, part := range parts[:len(parts)-1] {
+			switch child := node[part].(type) {
+			case nil:
+				next := make(keyTree)
+				node[part] = next
+				node = next
+			case keyTree:
+				node = child
+			default:
+				return nil, fmt.Errorf("Key %s is both a value and a directory", k)
+			}
+		}
+
+		leaf := parts[len(parts)-1]
+		if _, ok := node[leaf]; ok {
+			return nil, fmt.Errorf("Key %s is both a value and a directory", k)
+		}
+
+		var value interface{} = v
+		if valueFormat != "" {
+			var err error
+			if value, err = parseValue(valueFormat, v); err != nil {
+				return nil, fmt.Errorf("Could not parse %s as %s: %v", k, valueFormat, err)
+			}
+		}
+		node[leaf] = value
+	}
+
+	return tree, nil
+}
+
+func (tree keyTree) sortedKeys() []string {
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Calls f for every scalar in the tree, in key order, with the path to it.
+func (tree keyTree) walk(path []string, f func(path []string, value interface{})) {
+	walkValue(path, tree, f)
+}
+
+// Serialises a mapping's keys into one of the structured formats, parsing
+// their values first when there is a value format.  The output is ordered by
+// key, so the same keys always give the same bytes.
+func renderFormat(format string, valueFormat string, env map[string]string) ([]byte, error) {
+	tree, err := buildKeyTree(env, valueFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := new(bytes.Buffer)
+	switch format {
+	case outputFormatJSON:
+		data, err := json.MarshalIndent(tree, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buff.Write(data)
+		buff.WriteString("\n")
+	case outputFormatYAML:
+		data, err := encodeYAML(tree)
+		if err != nil {
+			return nil, err
+		}
+		buff.Write(data)
+	case outputFormatTOML:
+		if err := encodeTOML(buff, tree, nil); err != nil {
+			return nil, err
+		}
+	case outputFormatDotenv:
+		// Different keys can give the same name, and only one of them would
+		// take effect.
+		names := make(map[string]string)
+		tree.walk(nil, func(path []string, value interface{}) {
+			name := dotenvName(path)
+			if other, ok := names[name]; ok && err == nil {
+				err = fmt.Errorf("Keys %s and %s are both written as %s", other, strings.Join(path, "/"), name)
+			}
+			names[name] = strings.Join(path, "/")
+			fmt.Fprintf(buff, "%s=%s\n", name, dotenvQuote(scalarString(value)))
+		})
+		if err != nil {
+			return nil, err
+		}
+	case outputFormatProperties:
+		tree.walk(nil, func(path []string, value interface{}) {
+			fmt.Fprintf(buff, "%s=%s\n", propertiesEscape(strings.Join(path, "."), true), propertiesEscape(scalarString(value), false))
+		})
+	case outputFormatINI:
+		encodeINI(buff, tree)
+	default:
+		return nil, fmt.Errorf("Unknown output format: %s", format)
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Encodes a value as compact JSON.  JSON strings are valid in YAML and TOML
+// too, and JSON arrays and objects are valid YAML.
+func compactJSON(v interface{}) string {
+	buff := new(bytes.Buffer)
+	encoder := json.NewEncoder(buff)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+	return strings.TrimSuffix(buff.String(), "\n")
+}
+
+// Encodes a value as YAML, indented by two spaces.  Maps are written in key
+// order.
+func encodeYAML(v interface{}) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	encoder := yaml.NewEncoder(buff)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(yamlNumbers(v)); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKey(k string) string {
+	if tomlBareKey.MatchString(k) {
+		return k
+	}
+	return compactJSON(k)
+}
+
+// Writes a table's values, then each of its subtables under its own header.
+// TOML has no null, so null values are left out.
+func encodeTOML(buff *bytes.Buffer, tree keyTree, path []string) error {
+	keys := tree.sortedKeys()
+	for _, k := range keys {
+		if _, ok := tree[k].(keyTree); ok || tree[k] == nil {
+			continue
+		}
+		value, err := tomlValue(tree[k])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buff, "%s = %s\n", tomlKey(k), value)
+	}
+
+	for _, k := range keys {
+		child, ok := tree[k].(keyTree)
+		if !ok {
+			continue
+		}
+
+		// Tables holding only other tables are implied by their children.
+		childPath := append(path[:len(path):len(path)], tomlKey(k))
+		if len(child) == 0 || child.hasValues() {
+			if buff.Len() > 0 {
+				buff.WriteString("\n")
+			}
+			fmt.Fprintf(buff, "[%s]\n", strings.Join(childPath, "."))
+		}
+		if err := encodeTOML(buff, child, childPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (tree keyTree) hasValues() bool {
+	for _, value := range tree {
+		if _, ok := value.(keyTree); !ok && value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Encodes a value for the right-hand side of a TOML key, with lists as arrays
+// and objects inside them as inline tables.
+func tomlValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", fmt.Errorf("TOML can't represent a null inside a list")
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			encoded, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = encoded
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case keyTree:
+		var items []string
+		for _, k := range v.sortedKeys() {
+			if v[k] == nil {
+				continue
+			}
+			encoded, err := tomlValue(v[k])
+			if err != nil {
+				return "", err
+			}
+			items = append(items, tomlKey(k)+" = "+encoded)
+		}
+		if len(items) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(items, ", ") + " }", nil
+	}
+	return compactJSON(value), nil
+}
+
+var dotenvInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Names a variable after the path to its key, e.g. db/host becomes DB_HOST.
+func dotenvName(path []string) string {
+	return strings.ToUpper(dotenvInvalid.ReplaceAllString(strings.Join(path, "_"), "_"))
+}
+
+func dotenvQuote(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// Escapes a key or value for a Java properties file.
+func propertiesEscape(s string, isKey bool) string {
+	buff := new(bytes.Buffer)
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			buff.WriteString(`\\`)
+		case r == '\n':
+			buff.WriteString(`\n`)
+		case r == '\r':
+			buff.WriteString(`\r`)
+		case r == '\t':
+			buff.WriteString(`\t`)
+		case r == ' ' && (isKey || i == 0):
+			buff.WriteString(`\ `)
+		case isKey && strings.ContainsRune("=:#!", r):
+			buff.WriteRune('\\')
+			buff.WriteRune(r)
+		case r > 0x7e:
+			for _, unit := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(buff, `\u%04x`, unit)
+			}
+		default:
+			buff.WriteRune(r)
+		}
+	}
+	return buff.String()
+}
+
+// INI files only nest one level, so top-level directories become sections and
+// anything deeper is flattened into dotted names.
+func encodeINI(buff *bytes.Buffer, tree keyTree) {
+	keys := tree.sortedKeys()
+	for _, k := range keys {
+		if _, ok := tree[k].(keyTree); ok {
+			continue
+		}
+		walkValue([]string{k}, tree[k], func(path []string, value interface{}) {
+			fmt.Fprintf(buff, "%s = %s\n", strings.Join(path, "."), iniValue(scalarString(value)))
+		})
+	}
+
+	for _, k := range keys {
+		child, ok := tree[k].(keyTree)
+		if !ok {
+			continue
+		}
+
+		if buff.Len() > 0 {
+			buff.WriteString("\n")
+		}
+		fmt.Fprintf(buff, "[%s]\n", k)
+		child.walk(nil, func(path []string, value interface{}) {
+			fmt.Fprintf(buff, "%s = %s\n", strings.Join(path, "."), iniValue(scalarString(value)))
+		})
+	}
+}
+
+// Quotes values that would otherwise be misread: ones with line breaks,
+// comment characters, quotes or surrounding whitespace.
+func iniValue(s string) string {
+	if s != strings.TrimSpace(s) || strings.ContainsAny(s, "\r\n;#\"") {
+		return compactJSON(s)
+	}
+	return s
+}
+
+// formatFile serialises a mapping's keys into the single file at its path.
+type formatFile struct {
+	mapping  *MappingConfig
+	rendered []byte
+}
+
+func (f *formatFile) forget() {
+	f.rendered = nil
+}
+
+// Serialises the keys and writes them out, unless they would give the same
+// bytes as last time.  Values are decrypted first when there are keys to do it with.
+func (f *formatFile) render(env map[string]string) (bool, error) {
+	if decryptsValues(f.mapping) {
+		decrypted := make(map[string]string, len(env))
+		for k, v := range env {
+			value, err := decryptValue(f.mapping, v)
+			if err != nil {
+				return false, err
+			}
+			decrypted[k] = string(value)
+		}
+		env = decrypted
+	}
+
+	data, err := renderFormat(f.mapping.Format, f.mapping.ValueFormat, env)
+	if err != nil {
+		return false, err
+	}
+
+	if f.rendered != nil && bytes.Equal(f.rendered, data) {
+		return false, nil
+	}
+
+	if err := writeFileAtomic(f.mapping.Path, data); err != nil {
+		return false, err
+	}
+	f.rendered = data
+	return true, nil
+}
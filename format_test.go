@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+var formatTestEnv = map[string]string{
+	"name":         "app",
+	"db/host":      "db1",
+	"db/port":      "5432",
+	"db/pool/size": "10",
+	"motd":         "hi # there\n",
+	"folder/":      "",
+}
+
+func TestRenderFormat(t *testing.T) {
+	expected := map[string]string{
+		outputFormatJSON: `{
+  "db": {
+    "host": "db1",
+    "pool": {
+      "size": "10"
+    },
+    "port": "5432"
+  },
+  "motd": "hi # there\n",
+  "name": "app"
+}
+`,
+		outputFormatYAML: `db:
+  host: db1
+  pool:
+    size: "10"
+  port: "5432"
+motd: |
+  hi # there
+name: app
+`,
+		outputFormatTOML: `motd = "hi # there\n"
+name = "app"
+
+[db]
+host = "db1"
+port = "5432"
+
+[db.pool]
+size = "10"
+`,
+		outputFormatDotenv: `DB_HOST="db1"
+DB_POOL_SIZE="10"
+DB_PORT="5432"
+MOTD="hi # there\n"
+NAME="app"
+`,
+		outputFormatProperties: `db.host=db1
+db.pool.size=10
+db.port=5432
+motd=hi # there\n
+name=app
+`,
+		outputFormatINI: `motd = "hi # there\n"
+name = app
+
+[db]
+host = db1
+pool.size = 10
+port = 5432
+`,
+	}
+
+	for format, want := range expected {
+		// Render twice to be sure the output doesn't depend on map order.
+		for i := 0; i < 2; i++ {
+			data, err := renderFormat(format, "", formatTestEnv)
+			if err != nil {
+				t.Fatalf("%s: err: %v", format, err)
+			}
+			if string(data) != want {
+				t.Fatalf("%s: expected\n%s\ngot\n%s", format, want, data)
+			}
+		}
+	}
+}
+
+func TestRenderFormatErrors(t *testing.T) {
+	if _, err := renderFormat("xml", "", formatTestEnv); err == nil {
+		t.Fatalf("Expected an error for an unknown format")
+	}
+
+	env := map[string]string{"db": "x", "db/host": "y"}
+	if _, err := renderFormat(outputFormatJSON, "", env); err == nil {
+		t.Fatalf("Expected an error for a key that is also a directory")
+	}
+
+	env = map[string]string{"db/host": "x", "db-host": "y"}
+	if _, err := renderFormat(outputFormatDotenv, "", env); err == nil {
+		t.Fatalf("Expected an error for keys with the same variable name")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Keys ending in this are rendered as templates when a mapping has
+// KeyTemplates and no TemplateSuffix of its own.
+const defaultTemplateSuffix = ".tmpl"
+
+// nodeInfo describes the Consul agent a mapping reads from.
+type nodeInfo struct {
+	Name       string
+	Datacenter string
+	Meta       map[string]string
+}
+
+// Asks the agent for its node name, datacenter and metadata, using the given
+// ACL token.  Templates can still render without them, so a failure only
+// leaves them empty.
+func lookupNode(client *consulapi.Client, token string) *nodeInfo {
+	node := &nodeInfo{Meta: make(map[string]string)}
+
+	self, err := agentSelf(client, token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Unable to read node metadata from Consul agent")
+		return node
+	}
+
+	node.Name, _ = self["Config"]["NodeName"].(string)
+	node.Datacenter, _ = self["Config"]["Datacenter"].(string)
+	for k, v := range self["Meta"] {
+		node.Meta[k] = fmt.Sprint(v)
+	}
+	return node
+}
+
+// keyTemplateData is what a key rendered as a template is executed with.
+type keyTemplateData struct {
+	// The keys of the mapping, by their names relative to its prefixes.
+	Keys map[string]string
+
+	// The environment fsconsul runs in, when the mapping allows local access.
+	Env map[string]string
+
+	Hostname string
+	Node     *nodeInfo
+	Mapping  *mappingView
+
+	// Where keys outside the mapping's prefixes are looked up, if anywhere.
+	external *externalKeys
+}
+
+// mappingView is what templates see of a mapping's settings.  Credentials and
+// the paths of key files are left out, since templates come from Consul.
+type mappingView struct {
+	Prefix    string
+	Prefixes  []string
+	Path      string
+	DCs       []string
+	Namespace string
+	Partition string
+}
+
+func newKeyTemplateData(mappingConfig *MappingConfig, env map[string]string, node *nodeInfo, external *externalKeys) *keyTemplateData {
+	environment := make(map[string]string)
+	if mappingConfig.AllowLocalAccess {
+		for _, kv := range os.Environ() {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) == 2 {
+				environment[parts[0]] = parts[1]
+			}
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	if node == nil {
+		node = &nodeInfo{Meta: make(map[string]string)}
+	}
+
+	return &keyTemplateData{
+		Keys:     env,
+		Env:      environment,
+		Hostname: hostname,
+		Node:     node,
+		Mapping: &mappingView{
+			Prefix:    mappingConfig.Prefix,
+			Prefixes:  mappingConfig.Prefixes,
+			Path:      mappingConfig.Path,
+			DCs:       mappingConfig.DCs,
+			Namespace: mappingConfig.Namespace,
+			Partition: mappingConfig.Partition,
+		},
+		external: external,
+	}
+}
+
+func templateSuffix(mappingConfig *MappingConfig) string {
+	if mappingConfig.TemplateSuffix != "" {
+		return mappingConfig.TemplateSuffix
+	}
+	return defaultTemplateSuffix
+}
+
+// Reports whether a key is rendered as a template before being written.
+func isKeyTemplate(mappingConfig *MappingConfig, k string) bool {
+	return mappingConfig.KeyTemplates && strings.HasSuffix(k, templateSuffix(mappingConfig))
+}
+
+// Returns the name a key is written under, which for templates drops the
+// suffix that marked them.
+func keyFileName(mappingConfig *MappingConfig, k string) string {
+	if isKeyTemplate(mappingConfig, k) {
+		return strings.TrimSuffix(k, templateSuffix(mappingConfig))
+	}
+	return k
+}
+
+// Renders a key's value as a template.  The value is decrypted first, though
+// goDecrypt calls are left for the template to make, and the template can call
+// key, keyOrDefault, ls, tree and include over the mapping's keys and beyond.
+func renderKeyTemplate(mappingConfig *MappingConfig, data *keyTemplateData, k string, v string) ([]byte, error) {
+	decryptor, err := selectDecryptor(mappingConfig, []byte(v))
+	if err != nil {
+		return nil, err
+	}
+	if gosecret, ok := decryptor.(*gosecretDecryptor); ok {
+		gosecret.goDecrypt = false
+	}
+	if decryptor != nil {
+		decrypted, err := decryptor.decrypt([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+		v = string(decrypted)
+	}
+
+	scope := &templateScope{
+		mapping:     mappingConfig,
+		env:         data.Keys,
+		deps:        newTemplateDeps(),
+		external:    data.external,
+		localAccess: mappingConfig.AllowLocalAccess,
+		data:        data,
+		stack:       []string{k},
+	}
+	tmpl, err := template.New(k).Funcs(templateFuncs(scope)).Parse(v)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := new(bytes.Buffer)
+	if err := tmpl.Execute(buff, data); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLookupNode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/self" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "reader" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"Config": {"NodeName": "node-a", "Datacenter": "dc1"}, "Meta": {"rack": "r1"}}`)
+	}))
+	defer server.Close()
+
+	client, err := buildConsulClient(ConsulConfig{Addr: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	node := lookupNode(client, "reader")
+	if node.Name != "node-a" || node.Datacenter != "dc1" || node.Meta["rack"] != "r1" {
+		t.Fatalf("Unexpected node %+v", node)
+	}
+}
+
+func TestKeyTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul-keytemplates")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("FSCONSUL_TEST_REGION", "eu")
+	defer os.Unsetenv("FSCONSUL_TEST_REGION")
+
+	mappingConfig := &MappingConfig{
+		Prefix:           "app",
+		Path:             dir + "/",
+		KeyTemplates:     true,
+		AllowLocalAccess: true,
+	}
+	env := map[string]string{
+		"db/host":       "db1",
+		"app.conf.tmpl": `host={{index .Keys "db/host"}} port={{keyOrDefault "db/port" "5432"}} region={{.Env.FSCONSUL_TEST_REGION}} rack={{.Node.Meta.rack}} prefix={{.Mapping.Prefix}}`,
+		"raw.txt":       "{{not a template}}",
+	}
+	node := &nodeInfo{Name: "node-a", Meta: map[string]string{"rack": "r1"}}
+
+	syncKeys(mappingConfig, newKeyTemplateData(mappingConfig, env, node, nil), nil, env)
+
+	data, err := ioutil.ReadFile(path.Join(dir, "app.conf"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "host=db1 port=5432 region=eu rack=r1 prefix=app"
+	if string(data) != expected {
+		t.Fatalf("Expected %q, got %q", expected, data)
+	}
+
+	// Keys without the suffix are written as they are.
+	data, err = ioutil.ReadFile(path.Join(dir, "raw.txt"))
+	if err != nil || string(data) != "{{not a template}}" {
+		t.Fatalf("Expected the raw value, got %q %v", data, err)
+	}
+
+	// Removing the template removes the file it was written as.
+	next := map[string]string{"db/host": "db1", "raw.txt": "{{not a template}}"}
+	syncKeys(mappingConfig, newKeyTemplateData(mappingConfig, next, node, nil), env, next)
+	if _, err := os.Stat(path.Join(dir, "app.conf")); !os.IsNotExist(err) {
+		t.Fatalf("Expected app.conf to be removed, got %v", err)
+	}
+}
+
+func TestKeyTemplateMappingView(t *testing.T) {
+	mappingConfig := &MappingConfig{
+		Prefix:       "app",
+		KeyTemplates: true,
+		Consul:       &ConsulConfig{Token: "secret-token"},
+	}
+	data := newKeyTemplateData(mappingConfig, nil, nil, nil)
+
+	if _, err := renderKeyTemplate(mappingConfig, data, "a.tmpl", "{{.Mapping.Consul.Token}}"); err == nil {
+		t.Fatalf("Expected the mapping's Consul settings to be out of reach")
+	}
+	rendered, err := renderKeyTemplate(mappingConfig, data, "a.tmpl", "{{.Mapping.Prefix}}")
+	if err != nil || string(rendered) != "app" {
+		t.Fatalf("Expected app, got %q %v", rendered, err)
+	}
+}
+
+func TestKeyTemplateLocalAccess(t *testing.T) {
+	os.Setenv("FSCONSUL_PROBE_SECRET", "leaked")
+	defer os.Unsetenv("FSCONSUL_PROBE_SECRET")
+
+	mappingConfig := &MappingConfig{KeyTemplates: true}
+	keys := map[string]string{"shared": `{{env "FSCONSUL_PROBE_SECRET"}}`}
+	data := newKeyTemplateData(mappingConfig, keys, nil, nil)
+
+	// Without local access, templates from Consul can't read the machine.
+	for _, text := range []string{
+		`{{env "FSCONSUL_PROBE_SECRET"}}`,
+		`{{file "/etc/hostname"}}`,
+		`{{include "shared"}}`,
+	} {
+		if _, err := renderKeyTemplate(mappingConfig, data, "a.tmpl", text); err == nil {
+			t.Fatalf("Expected an error from %q", text)
+		}
+	}
+	rendered, err := renderKeyTemplate(mappingConfig, data, "a.tmpl", `{{len .Env}}`)
+	if err != nil || string(rendered) != "0" {
+		t.Fatalf("Expected an empty environment, got %q %v", rendered, err)
+	}
+
+	// With it, they can.
+	mappingConfig.AllowLocalAccess = true
+	data = newKeyTemplateData(mappingConfig, keys, nil, nil)
+	rendered, err = renderKeyTemplate(mappingConfig, data, "a.tmpl", `{{include "shared"}} {{.Env.FSCONSUL_PROBE_SECRET}}`)
+	if err != nil || string(rendered) != "leaked leaked" {
+		t.Fatalf("Expected leaked leaked, got %q %v", rendered, err)
+	}
+}
+
+func TestKeyTemplateSuffix(t *testing.T) {
+	mappingConfig := &MappingConfig{KeyTemplates: true, TemplateSuffix: ".tpl"}
+	if !isKeyTemplate(mappingConfig, "a.conf.tpl") || isKeyTemplate(mappingConfig, "a.conf.tmpl") {
+		t.Fatalf("Expected only keys ending in .tpl to be templates")
+	}
+	if keyFileName(mappingConfig, "a.conf.tpl") != "a.conf" {
+		t.Fatalf("Expected the suffix to be dropped")
+	}
+
+	mappingConfig.KeyTemplates = false
+	if isKeyTemplate(mappingConfig, "a.conf.tpl") {
+		t.Fatalf("Expected no templates without KeyTemplates")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+)
+
+// KeystoreDirs lists directories of keys, searched in order.  In JSON it is
+// either a single directory or a list of them.
+type KeystoreDirs []string
+
+func (dirs *KeystoreDirs) UnmarshalJSON(data []byte) error {
+	var dir string
+	if err := json.Unmarshal(data, &dir); err == nil {
+		*dirs = parseKeystoreDirs(dir)
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("Keystore must be a directory or a list of directories")
+	}
+	*dirs = list
+	return nil
+}
+
+// Splits a pipe-delimited list of directories, as given on the command line.
+func parseKeystoreDirs(s string) KeystoreDirs {
+	return splitList(s)
+}
+
+// Splits a pipe-delimited list, as given on the command line.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "|")
+}
+
+// keyChain finds the key that decrypts a tag, looking the tag's key name and
+// then each of its aliases up in every keystore directory in turn.
+type keyChain struct {
+	dirs    []string
+	aliases map[string][]string
+}
+
+func newKeyChain(mappingConfig *MappingConfig) *keyChain {
+	return &keyChain{
+		dirs:    mappingConfig.Keystore,
+		aliases: mappingConfig.KeyAliases,
+	}
+}
+
+// keyFile is a key name and the directory holding a file for it.
+type keyFile struct {
+	dir  string
+	name string
+}
+
+// Returns the key files that exist for a key name, in the order they should
+// be tried.
+func (c *keyChain) candidates(name string) []keyFile {
+	var files []keyFile
+	for _, n := range append([]string{name}, c.aliases[name]...) {
+		for _, dir := range c.dirs {
+			if _, err := os.Stat(filepath.Join(dir, n)); err == nil {
+				files = append(files, keyFile{dir, n})
+			}
+		}
+	}
+	return files
+}
+
+// Decrypts a tag given as its authData, cipherText, initVector and keyName,
+// with the first key that can.  A key with the right name can still be the
+// wrong one, e.g. the old and new versions of a rotated key, so every
+// candidate is tried before giving up.
+func (c *keyChain) decrypt(fields ...string) ([]byte, error) {
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("Encrypted tag has %d fields, expected 4", len(fields))
+	}
+
+	files := c.candidates(fields[3])
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Key not found in keystore: %s", fields[3])
+	}
+
+	var err error
+	for _, file := range files {
+		var plaintext []byte
+		plaintext, err = gosecret.ParseDecryptionTag(file.dir, fields[0], fields[1], fields[2], file.name)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, err
+}
+
+// Replaces every [gosecret|...] tag in the content with its plaintext.
+func (c *keyChain) decryptTags(content []byte) ([]byte, error) {
+	var firstErr error
+	decrypted := gosecretTag.ReplaceAllFunc(content, func(tag []byte) []byte {
+		fields := strings.Split(string(gosecretTag.FindSubmatch(tag)[1]), "|")
+		if len(fields) != 4 {
+			return tag
+		}
+
+		plaintext, err := c.decrypt(fields...)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return tag
+		}
+		return plaintext
+	})
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return decrypted, nil
+}
+
+// Replaces every {{goDecrypt "authData" "cipherText" "initVector" "keyName"}}
+// tag in the content with its plaintext.
+func (c *keyChain) decryptGoDecryptTags(content []byte) ([]byte, error) {
+	var firstErr error
+	decrypted := goDecryptTag.ReplaceAllFunc(content, func(tag []byte) []byte {
+		args, err := unquoteArguments(goDecryptTag.FindSubmatch(tag)[1])
+		if err == nil {
+			var plaintext []byte
+			if plaintext, err = c.decrypt(args...); err == nil {
+				return plaintext
+			}
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("Could not decrypt %s: %v", tag, err)
+		}
+		return tag
+	})
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return decrypted, nil
+}
+
+// Returns the key names that no keystore directory has a file for, under the
+// name itself or any of its aliases.
+func (c *keyChain) missing(names []string) []string {
+	var missing []string
+	for _, name := range names {
+		if len(c.candidates(name)) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
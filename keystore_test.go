@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+)
+
+func TestKeystoreDirsJSON(t *testing.T) {
+	cases := map[string]KeystoreDirs{
+		`{"keystore": "ks"}`:                {"ks"},
+		`{"keystore": "old|new"}`:           {"old", "new"},
+		`{"keystore": ["old", "new"]}`:      {"old", "new"},
+		`{"keystore": ""}`:                  nil,
+		`{"keyAliases": {"app": ["app2"]}}`: nil,
+	}
+	for blob, expected := range cases {
+		var mapping MappingConfig
+		if err := json.Unmarshal([]byte(blob), &mapping); err != nil {
+			t.Fatalf("%s: %v", blob, err)
+		}
+		if !reflect.DeepEqual(mapping.Keystore, expected) {
+			t.Fatalf("%s: expected %v, got %v", blob, expected, mapping.Keystore)
+		}
+	}
+
+	var mapping MappingConfig
+	if err := json.Unmarshal([]byte(`{"keystore": 3}`), &mapping); err == nil {
+		t.Fatalf("Expected an error for a keystore that isn't a directory")
+	}
+}
+
+// Writes a fresh key to a keystore and returns a value encrypted with it.
+func encryptWithNewKey(t *testing.T, keystore string, keyName string, plaintext string) string {
+	key := base64.StdEncoding.EncodeToString(gosecret.CreateKey())
+	if err := ioutil.WriteFile(path.Join(keystore, keyName), []byte(key), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tag, err := goEncryptFunc(keystore)("auth", plaintext, keyName)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return tag
+}
+
+func TestKeyChain(t *testing.T) {
+	oldDir, _ := ioutil.TempDir("", "fsconsul-keys-old")
+	newDir, _ := ioutil.TempDir("", "fsconsul-keys-new")
+	defer os.RemoveAll(oldDir)
+	defer os.RemoveAll(newDir)
+
+	// Mid-rotation, both directories hold a key called app, and values are
+	// encrypted with either.  A value encrypted with a renamed key still names
+	// the key it used to have.
+	oldValue := encryptWithNewKey(t, oldDir, "app", "old secret")
+	newValue := encryptWithNewKey(t, newDir, "app", "new secret")
+	renamedValue := encryptWithNewKey(t, newDir, "app-2024", "renamed secret")
+	renamedValue = renamedValue[:len(renamedValue)-len(`"app-2024"}}`)] + `"legacy"}}`
+
+	mapping := &MappingConfig{
+		Keystore:   KeystoreDirs{newDir, oldDir},
+		KeyAliases: map[string][]string{"legacy": {"app-2024"}},
+	}
+	for value, expected := range map[string]string{
+		oldValue:     "old secret",
+		newValue:     "new secret",
+		renamedValue: "renamed secret",
+	} {
+		decrypted, err := decryptValue(mapping, value)
+		if err != nil {
+			t.Fatalf("Could not decrypt %q: %v", value, err)
+		}
+		if string(decrypted) != expected {
+			t.Fatalf("Expected %q, got %q", expected, decrypted)
+		}
+	}
+
+	// Without the old directory, its values can't be decrypted.
+	if _, err := decryptValue(&MappingConfig{Keystore: KeystoreDirs{newDir}}, oldValue); err == nil {
+		t.Fatalf("Expected an error decrypting with the wrong key")
+	}
+
+	keys := newKeyChain(mapping)
+	if missing := keys.missing([]string{"app", "legacy", "other"}); !reflect.DeepEqual(missing, []string{"other"}) {
+		t.Fatalf("Expected only other to be missing, got %v", missing)
+	}
+	if _, err := keys.decrypt("auth", "AAAA", "AAAA", "other"); err == nil || err.Error() != "Key not found in keystore: other" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestKeyChainGosecretTags(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fsconsul-keys")
+	defer os.RemoveAll(dir)
+	key := base64.StdEncoding.EncodeToString(gosecret.CreateKey())
+	ioutil.WriteFile(path.Join(dir, "renamed"), []byte(key), 0600)
+
+	dt, err := gosecret.ParseEncrytionTag(dir, "auth", "secret", "renamed")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	value := "password=[gosecret|auth|" + base64.StdEncoding.EncodeToString(dt.CipherText) + "|" +
+		base64.StdEncoding.EncodeToString(dt.InitVector) + "|original]"
+
+	mapping := &MappingConfig{
+		Keystore:   KeystoreDirs{testKeystore, dir},
+		KeyAliases: map[string][]string{"original": {"renamed"}},
+	}
+	decrypted, err := decryptValue(mapping, value)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(decrypted) != "password=secret" {
+		t.Fatalf("Expected password=secret, got %q", decrypted)
+	}
+}
@@ -18,10 +18,28 @@ func main() {
 }
 
 func realMain() int {
+	if code, ok := runCommand(os.Args[1:]); ok {
+		return code
+	}
+
 	var consulAddr string
 	var consulDC string
 	var keystore string
 	var token string
+	var tokenFile string
+	var namespace string
+	var partition string
+	var useTLS bool
+	var caFile string
+	var caPath string
+	var certFile string
+	var keyFile string
+	var tlsServerName string
+	var tlsMinVersion string
+	var tlsCipherSuites string
+	var tlsSkipVerify bool
+	var httpAuthFile string
+	var proxy string
 	var configFile string
 	var once bool
 
@@ -37,10 +55,52 @@ func realMain() int {
 		"consul datacenter, uses local if blank")
 	flag.StringVar(
 		&keystore, "keystore", "",
-		"directory of keys used for decryption")
+		"directories of keys used for decryption, pipe-delimited and searched in order")
 	flag.StringVar(
 		&token, "token", "",
 		"token to use for ACL access")
+	flag.StringVar(
+		&tokenFile, "tokenFile", "",
+		"file holding the token to use for ACL access, re-read when it changes")
+	flag.StringVar(
+		&namespace, "namespace", "",
+		"consul enterprise namespace to read keys from")
+	flag.StringVar(
+		&partition, "partition", "",
+		"consul enterprise admin partition to read keys from")
+	flag.BoolVar(
+		&useTLS, "useTLS", false,
+		"connect to consul over HTTPS")
+	flag.StringVar(
+		&caFile, "caFile", "",
+		"CA certificate file used to verify consul")
+	flag.StringVar(
+		&caPath, "caPath", "",
+		"directory of CA certificates used to verify consul")
+	flag.StringVar(
+		&certFile, "certFile", "",
+		"client certificate file presented to consul")
+	flag.StringVar(
+		&keyFile, "keyFile", "",
+		"client key file presented to consul")
+	flag.StringVar(
+		&tlsServerName, "tlsServerName", "",
+		"server name expected on consul's certificate, if not the host in -addr")
+	flag.StringVar(
+		&tlsMinVersion, "tlsMinVersion", "",
+		"minimum TLS version to accept, e.g. 1.2")
+	flag.StringVar(
+		&tlsCipherSuites, "tlsCipherSuites", "",
+		"comma-separated list of TLS cipher suites to allow")
+	flag.BoolVar(
+		&tlsSkipVerify, "tlsSkipVerify", false,
+		"do not verify consul's certificate (insecure, for labs only)")
+	flag.StringVar(
+		&httpAuthFile, "httpAuthFile", "",
+		"file holding username:password for HTTP basic auth to consul")
+	flag.StringVar(
+		&proxy, "proxy", "",
+		"URL of an HTTP(S) proxy to reach consul through")
 	flag.BoolVar(
 		&once, "once", false,
 		"run once and exit")
@@ -97,9 +157,26 @@ func realMain() int {
 		config = WatchConfig{
 			RunOnce: once,
 			Consul: ConsulConfig{
-				Addr:  consulAddr,
-				DC:    consulDC,
-				Token: token,
+				Addr:      consulAddr,
+				DC:        consulDC,
+				Token:     token,
+				TokenFile: tokenFile,
+
+				Namespace: namespace,
+				Partition: partition,
+
+				UseTLS:          useTLS,
+				CAFile:          caFile,
+				CAPath:          caPath,
+				CertFile:        certFile,
+				KeyFile:         keyFile,
+				TLSServerName:   tlsServerName,
+				TLSMinVersion:   tlsMinVersion,
+				TLSCipherSuites: tlsCipherSuites,
+				TLSSkipVerify:   tlsSkipVerify,
+
+				HTTPAuthFile: httpAuthFile,
+				Proxy:        proxy,
 			},
 			Mappings: make([]MappingConfig, len(prefixes)),
 		}
@@ -108,7 +185,7 @@ func realMain() int {
 			config.Mappings[i] = MappingConfig{
 				Prefix:   prefixes[i],
 				Path:     paths[i],
-				Keystore: keystore,
+				Keystore: parseKeystoreDirs(keystore),
 				OnChange: onChange,
 			}
 		}
@@ -125,6 +202,10 @@ func usage() {
 
 const helpText = `
 Usage: %s [options] prefix path onchange
+       %[1]s encrypt [options] [file]
+       %[1]s encrypt-file [options] [file]
+       %[1]s decrypt [options] [file]
+       %[1]s rekey [options]
 
   Write files to the specified locations on the local system by reading K/Vs
   from Consul's K/V store with the given prefixes and executing a program on
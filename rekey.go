@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Re-encrypts every tag in a value that uses the old key with the new one,
+// keeping each tag's form.  Returns the new value and how many tags changed.
+func rekeyValue(content []byte, keystore string, oldKeyName string, newKeyName string) ([]byte, int, error) {
+	encrypt := goEncryptFunc(keystore)
+	rekeyed := 0
+
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	content = goDecryptTag.ReplaceAllFunc(content, func(tag []byte) []byte {
+		args, err := unquoteArguments(goDecryptTag.FindSubmatch(tag)[1])
+		if err != nil {
+			fail(fmt.Errorf("Could not read %s: %v", tag, err))
+			return tag
+		}
+		if len(args) != 4 || args[3] != oldKeyName {
+			return tag
+		}
+
+		plaintext, err := gosecret.ParseDecryptionTag(keystore, args...)
+		if err != nil {
+			fail(err)
+			return tag
+		}
+		encrypted, err := encrypt(args[0], string(plaintext), newKeyName)
+		if err != nil {
+			fail(err)
+			return tag
+		}
+
+		rekeyed++
+		return []byte(encrypted)
+	})
+
+	content = gosecretTag.ReplaceAllFunc(content, func(tag []byte) []byte {
+		fields := strings.Split(string(gosecretTag.FindSubmatch(tag)[1]), "|")
+		if len(fields) != 4 || fields[3] != oldKeyName {
+			return tag
+		}
+
+		plaintext, err := gosecret.ParseDecryptionTag(keystore, fields...)
+		if err != nil {
+			fail(err)
+			return tag
+		}
+		dt, err := gosecret.ParseEncrytionTag(keystore, fields[0], string(plaintext), newKeyName)
+		if err != nil {
+			fail(err)
+			return tag
+		}
+
+		rekeyed++
+		return []byte(fmt.Sprintf("[gosecret|%s|%s|%s|%s]",
+			dt.AuthData,
+			base64.StdEncoding.EncodeToString(dt.CipherText),
+			base64.StdEncoding.EncodeToString(dt.InitVector),
+			dt.KeyName))
+	})
+
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return content, rekeyed, nil
+}
+
+// Re-encrypts the values under a prefix from one key to another, writing each
+// back only if nobody has changed it in the meantime.
+func rekeyCommand(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	var keystore string
+	var prefix string
+	var oldKeyName string
+	var newKeyName string
+	var dryRun bool
+	var consulConfig ConsulConfig
+
+	flags := commandFlags("rekey", "rekey [options]", stderr)
+	flags.StringVar(
+		&keystore, "keystore", "",
+		"directory holding both the old and the new key")
+	flags.StringVar(
+		&prefix, "prefix", "",
+		"consul prefix whose values are re-encrypted")
+	flags.StringVar(
+		&oldKeyName, "oldKeyName", "",
+		"name of the key the values are encrypted with now")
+	flags.StringVar(
+		&newKeyName, "newKeyName", "",
+		"name of the key to re-encrypt the values with")
+	flags.BoolVar(
+		&dryRun, "dryRun", false,
+		"report what would be re-encrypted without writing anything")
+	consulFlags(flags, &consulConfig)
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if keystore == "" || prefix == "" || oldKeyName == "" || newKeyName == "" {
+		flags.Usage()
+		return 1
+	}
+
+	config := WatchConfig{Consul: consulConfig}
+	applyDefaults(&config)
+
+	client, err := buildConsulClient(config.Consul)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to create consul client: %v\n", err)
+		return 2
+	}
+	tokens := newTokenSource(config.Consul)
+
+	prefix = strings.TrimPrefix(prefix, "/")
+	result, _, err := runQuery(client, prefix, kvListQuery(prefix), tokens, consulapi.QueryOptions{})
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to list %s: %v\n", prefix, err)
+		return 2
+	}
+
+	var migrated, failed int
+	for _, pair := range result.(consulapi.KVPairs) {
+		value, tags, err := rekeyValue(pair.Value, keystore, oldKeyName, newKeyName)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not rekey %s: %v\n", pair.Key, err)
+			failed++
+			continue
+		}
+		if tags == 0 {
+			continue
+		}
+
+		if dryRun {
+			fmt.Fprintf(stdout, "Would rekey %s (%d tags)\n", pair.Key, tags)
+			migrated++
+			continue
+		}
+
+		rekeyed := &consulapi.KVPair{Key: pair.Key, Flags: pair.Flags, Value: value, ModifyIndex: pair.ModifyIndex}
+		ok, _, err := client.KV().CAS(rekeyed, &consulapi.WriteOptions{Token: tokens.Token()})
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not rekey %s: %v\n", pair.Key, err)
+			failed++
+			continue
+		}
+		if !ok {
+			fmt.Fprintf(stderr, "Could not rekey %s: it changed since it was read\n", pair.Key)
+			failed++
+			continue
+		}
+
+		fmt.Fprintf(stdout, "Rekeyed %s (%d tags)\n", pair.Key, tags)
+		migrated++
+	}
+
+	if dryRun {
+		fmt.Fprintf(stdout, "%d keys would be rekeyed, %d could not be\n", migrated, failed)
+	} else {
+		fmt.Fprintf(stdout, "%d keys rekeyed, %d could not be\n", migrated, failed)
+	}
+	if failed > 0 {
+		return 2
+	}
+	return 0
+}
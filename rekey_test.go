@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// casKV is an in-memory K/V store that honours check-and-set writes.
+type casKV struct {
+	lock  sync.Mutex
+	pairs map[string]*consulapi.KVPair
+	index uint64
+
+	// Called after every list, to simulate other writers.
+	afterList func()
+}
+
+func (kv *casKV) put(key string, value string) {
+	kv.index++
+	kv.pairs[key] = &consulapi.KVPair{Key: key, Value: []byte(value), ModifyIndex: kv.index}
+}
+
+func (kv *casKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	switch r.Method {
+	case "GET":
+		var pairs consulapi.KVPairs
+		for k, pair := range kv.pairs {
+			if strings.HasPrefix(k, key) {
+				pairs = append(pairs, pair)
+			}
+		}
+		w.Header().Set("X-Consul-Index", fmt.Sprint(kv.index))
+		json.NewEncoder(w).Encode(pairs)
+		if kv.afterList != nil {
+			kv.afterList()
+		}
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if pair, ok := kv.pairs[key]; !ok || r.URL.Query().Get("cas") != fmt.Sprint(pair.ModifyIndex) {
+			fmt.Fprint(w, "false")
+			return
+		}
+		kv.put(key, string(body))
+		fmt.Fprint(w, "true")
+	}
+}
+
+func TestRekeyCommand(t *testing.T) {
+	// A keystore with the test key and a new one to move to.
+	keystore, err := ioutil.TempDir("", "fsconsul-rekey")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(keystore)
+
+	oldKey, _ := ioutil.ReadFile(path.Join(testKeystore, "fsconsul_test_key"))
+	ioutil.WriteFile(path.Join(keystore, "fsconsul_test_key"), oldKey, 0600)
+	ioutil.WriteFile(path.Join(keystore, "new_key"), []byte(base64.StdEncoding.EncodeToString(gosecret.CreateKey())), 0600)
+
+	encrypted, _ := ioutil.ReadFile("test_data/encrypted_file")
+	kv := &casKV{pairs: make(map[string]*consulapi.KVPair)}
+	kv.put("app/config", string(encrypted))
+	kv.put("app/plain", "nothing to see")
+	kv.put("app/broken", `{{goDecrypt "a" "AAAA" "AAAAAAAAAAAAAAAA" "fsconsul_test_key"}}`)
+
+	server := httptest.NewServer(kv)
+	defer server.Close()
+
+	args := []string{
+		"-keystore", keystore,
+		"-addr", server.Listener.Addr().String(),
+		"-prefix", "app/",
+		"-oldKeyName", "fsconsul_test_key",
+		"-newKeyName", "new_key",
+	}
+
+	// A dry run reports without writing.
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	if code := rekeyCommand(append(args, "-dryRun"), nil, stdout, stderr); code != 2 {
+		t.Fatalf("Expected a failure for the broken key, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), "Would rekey app/config (2 tags)") ||
+		!strings.Contains(stderr.String(), "Could not rekey app/broken") {
+		t.Fatalf("Unexpected report %q %q", stdout, stderr)
+	}
+	if string(kv.pairs["app/config"].Value) != string(encrypted) {
+		t.Fatalf("Expected a dry run to leave the value alone")
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	rekeyCommand(args, nil, stdout, stderr)
+	if !strings.Contains(stdout.String(), "Rekeyed app/config (2 tags)") || !strings.Contains(stdout.String(), "1 keys rekeyed, 1 could not be") {
+		t.Fatalf("Unexpected report %q %q", stdout, stderr)
+	}
+
+	value := kv.pairs["app/config"].Value
+	if names := referencedKeyNames(value); len(names) != 1 || names[0] != "new_key" {
+		t.Fatalf("Expected only new_key to be referenced, got %v", names)
+	}
+	decrypted, err := decryptValue(&MappingConfig{Keystore: KeystoreDirs{keystore}}, string(value))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected, _ := ioutil.ReadFile("test_data/decrypted_file")
+	if string(decrypted) != string(expected) {
+		t.Fatalf("Expected %q, got %q", expected, decrypted)
+	}
+	if string(kv.pairs["app/plain"].Value) != "nothing to see" {
+		t.Fatalf("Expected values without tags to be left alone")
+	}
+}
+
+func TestRekeyCheckAndSet(t *testing.T) {
+	encrypted, _ := ioutil.ReadFile("test_data/encrypted_file")
+	kv := &casKV{pairs: make(map[string]*consulapi.KVPair)}
+	kv.put("app/config", string(encrypted))
+
+	// Someone else writes the key between fsconsul reading and writing it.
+	kv.afterList = func() {
+		kv.put("app/config", "changed")
+	}
+
+	server := httptest.NewServer(kv)
+	defer server.Close()
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	args := []string{
+		"-keystore", testKeystore,
+		"-addr", server.Listener.Addr().String(),
+		"-prefix", "app/",
+		"-oldKeyName", "fsconsul_test_key",
+		"-newKeyName", "fsconsul_test_key",
+	}
+	if code := rekeyCommand(args, nil, stdout, stderr); code != 2 {
+		t.Fatalf("Expected a failure, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "Could not rekey app/config: it changed since it was read") {
+		t.Fatalf("Unexpected report %q", stderr)
+	}
+	if string(kv.pairs["app/config"].Value) != "changed" {
+		t.Fatalf("Expected the other write to survive")
+	}
+}
+
+func TestRekeyValueInvalidEscape(t *testing.T) {
+	tag := `{{goDecrypt "\q" "AAAA" "AAAAAAAAAAAAAAAA" "fsconsul_test_key"}}`
+	if _, _, err := rekeyValue([]byte(tag), testKeystore, "fsconsul_test_key", "new_key"); err == nil || !strings.Contains(err.Error(), "Invalid argument") {
+		t.Fatalf("Expected an error for an invalid escape, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/armed/mkdirp"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Ways a service mapping can render its instances.
+const (
+	serviceFormatJSON     = "json"
+	serviceFormatHosts    = "hosts"
+	serviceFormatTemplate = "template"
+)
+
+// serviceInstance is what gets rendered for each instance of a service.
+type serviceInstance struct {
+	ID      string
+	Service string
+	Node    string
+	Address string
+	Port    int
+	Tags    []string
+	Meta    map[string]string
+	Status  string
+}
+
+// Lists the instances of a service through the Health API.
+func serviceQuery(mappingConfig *MappingConfig) consulQuery {
+	passingOnly := mappingConfig.ServiceHealth != "any"
+	return func(client *consulapi.Client, opts *consulapi.QueryOptions) (interface{}, *consulapi.QueryMeta, error) {
+		return client.Health().ServiceMultipleTags(mappingConfig.Service, mappingConfig.ServiceTags, passingOnly, opts)
+	}
+}
+
+// Turns the Health API entries into instances, sorted so that unchanged
+// membership always renders the same bytes.
+func serviceInstances(entries []*consulapi.ServiceEntry) []serviceInstance {
+	instances := make([]serviceInstance, len(entries))
+	for i, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+
+		instances[i] = serviceInstance{
+			ID:      entry.Service.ID,
+			Service: entry.Service.Service,
+			Node:    entry.Node.Node,
+			Address: address,
+			Port:    entry.Service.Port,
+			Tags:    entry.Service.Tags,
+			Meta:    entry.Service.Meta,
+			Status:  entry.Checks.AggregatedStatus(),
+		}
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Node != instances[j].Node {
+			return instances[i].Node < instances[j].Node
+		}
+		return instances[i].ID < instances[j].ID
+	})
+
+	return instances
+}
+
+// Renders instances as JSON, a hosts file, or through a user's template.
+func renderServiceInstances(mappingConfig *MappingConfig, tmpl *template.Template, instances []serviceInstance) ([]byte, error) {
+	switch mappingConfig.ServiceFormat {
+	case "", serviceFormatJSON:
+		data, err := json.MarshalIndent(instances, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+
+	case serviceFormatHosts:
+		buff := new(bytes.Buffer)
+		seen := make(map[string]bool)
+		for _, instance := range instances {
+			line := fmt.Sprintf("%s\t%s\n", instance.Address, instance.Node)
+			if !seen[line] {
+				seen[line] = true
+				buff.WriteString(line)
+			}
+		}
+		return buff.Bytes(), nil
+
+	case serviceFormatTemplate:
+		buff := new(bytes.Buffer)
+		if err := tmpl.Execute(buff, instances); err != nil {
+			return nil, err
+		}
+		return buff.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("Unknown service format: %s", mappingConfig.ServiceFormat)
+}
+
+// Writes a file by way of a temporary file in the same directory, so readers
+// never see it half written.
+func writeFileAtomic(file string, data []byte) error {
+	dir := filepath.Dir(file)
+	if err := mkdirp.Mk(dir, 0777); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
+
+// Watches the instances of a service and renders them into the file at the
+// mapping's path, running the onchange command whenever they change.
+func watchServiceAndExec(config *WatchConfig, mappingConfig *MappingConfig, clients []*consulapi.Client) (int, error) {
+	var tmpl *template.Template
+	if mappingConfig.ServiceFormat == serviceFormatTemplate {
+		var err error
+		tmpl, err = template.New(filepath.Base(mappingConfig.ServiceTemplate)).Funcs(withTemplateLibrary(localTemplateFuncs())).ParseFiles(mappingConfig.ServiceTemplate)
+		if err != nil {
+			return 1, err
+		}
+	}
+
+	resultCh := make(chan interface{})
+	errCh := make(chan error, 1)
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+
+	go watch(clients, mappingConfig.Service, serviceQuery(mappingConfig),
+		newTokenSource(mappingCandidates(config.Consul, mappingConfig)[0]), resultCh, errCh, quitCh)
+
+	var rendered []byte
+	for {
+		var entries []*consulapi.ServiceEntry
+
+		// Wait for new instances to come on our channel or an error
+		// to occur.
+		select {
+		case result := <-resultCh:
+			entries = result.([]*consulapi.ServiceEntry)
+		case err := <-errCh:
+			return 1, err
+		}
+
+		// A failed render leaves the file as it was until the instances change
+		// again, except in a -once run, which fails.
+		data, err := renderServiceInstances(mappingConfig, tmpl, serviceInstances(entries))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"service": mappingConfig.Service,
+				"file":    mappingConfig.Path,
+			}).Error("Failed to render service instances")
+			if config.RunOnce {
+				return 1, err
+			}
+			continue
+		}
+
+		// If the instances didn't actually change,
+		// then don't do anything.
+		if rendered != nil && bytes.Equal(rendered, data) {
+			continue
+		}
+
+		if err := writeFileAtomic(mappingConfig.Path, data); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"file":  mappingConfig.Path,
+			}).Error("Failed to write service file")
+			continue
+		}
+		rendered = data
+
+		log.WithFields(log.Fields{
+			"service":   mappingConfig.Service,
+			"instances": len(entries),
+			"file":      mappingConfig.Path,
+		}).Debug("Successfully wrote service instances to file")
+
+		// Membership changed, run our onchange command, if one was specified.
+		if err := runOnChange(mappingConfig); err != nil {
+			return 111, err
+		}
+
+		// If we are only running once, stop watching for this mapping.
+		if config.RunOnce {
+			return 0, nil
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const serviceEntries = `[
+	{
+		"Node": {"Node": "node-b", "Address": "10.0.0.2"},
+		"Service": {"ID": "web-2", "Service": "web", "Port": 8080, "Tags": ["prod"]},
+		"Checks": [{"Status": "passing"}]
+	},
+	{
+		"Node": {"Node": "node-a", "Address": "10.0.0.1"},
+		"Service": {"ID": "web-1", "Service": "web", "Address": "10.1.0.1", "Port": 8080, "Tags": ["prod"]},
+		"Checks": [{"Status": "passing"}]
+	}
+]`
+
+func TestServiceMapping(t *testing.T) {
+	query := make(chan url.Values, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/web" {
+			http.NotFound(w, r)
+			return
+		}
+		// Only the initial read of each test is of interest.
+		if r.URL.Query().Get("index") == "" {
+			query <- r.URL.Query()
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, serviceEntries)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	templateFile := path.Join(dir, "upstreams.tmpl")
+	ioutil.WriteFile(templateFile, []byte(`{{range .}}server {{.Address}}:{{.Port}};
+{{end}}`), 0600)
+
+	for _, test := range []struct {
+		mapping      MappingConfig
+		tag, passing string
+		expected     string
+	}{
+		{
+			MappingConfig{Service: "web", ServiceFormat: "hosts", ServiceTags: []string{"prod"}},
+			"prod", "1",
+			"10.1.0.1\tnode-a\n10.0.0.2\tnode-b\n",
+		},
+		{
+			MappingConfig{Service: "web", ServiceFormat: "template", ServiceTemplate: templateFile, ServiceHealth: "any"},
+			"", "",
+			"server 10.1.0.1:8080;\nserver 10.0.0.2:8080;\n",
+		},
+	} {
+		test.mapping.Path = path.Join(dir, "out", test.mapping.ServiceFormat)
+		config := WatchConfig{
+			RunOnce:  true,
+			Consul:   ConsulConfig{Addr: server.Listener.Addr().String()},
+			Mappings: []MappingConfig{test.mapping},
+		}
+
+		if rvalue := watchAndExec(&config); rvalue != 0 {
+			t.Fatalf("watchAndExec returned %d", rvalue)
+		}
+
+		values := <-query
+		if values.Get("tag") != test.tag || values.Get("passing") != test.passing {
+			t.Fatalf("Unexpected query %v", values)
+		}
+
+		actual, err := ioutil.ReadFile(test.mapping.Path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(actual) != test.expected {
+			t.Fatalf("Rendered %q, expected %q", actual, test.expected)
+		}
+	}
+}
+
+func TestServiceMappingRenderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, serviceEntries)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// No instance has a zone, so the template fails for every one.
+	templateFile := path.Join(dir, "upstreams.tmpl")
+	ioutil.WriteFile(templateFile, []byte(`{{range .}}{{index .Meta "zone" | required "zone is missing"}}
+{{end}}`), 0600)
+
+	config := WatchConfig{
+		RunOnce: true,
+		Consul:  ConsulConfig{Addr: server.Listener.Addr().String()},
+		Mappings: []MappingConfig{{
+			Service:         "web",
+			ServiceFormat:   "template",
+			ServiceTemplate: templateFile,
+			Path:            path.Join(dir, "upstreams"),
+		}},
+	}
+	if rvalue := watchAndExec(&config); rvalue == 0 {
+		t.Fatalf("Expected watchAndExec to fail")
+	}
+	if _, err := os.Stat(path.Join(dir, "upstreams")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file, got %v", err)
+	}
+}
+
+func TestRenderServiceInstancesJSON(t *testing.T) {
+	var entries []*consulapi.ServiceEntry
+	if err := json.Unmarshal([]byte(serviceEntries), &entries); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	data, err := renderServiceInstances(&MappingConfig{}, nil, serviceInstances(entries))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var instances []serviceInstance
+	if err := json.Unmarshal(data, &instances); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(instances) != 2 || instances[0].ID != "web-1" || instances[0].Address != "10.1.0.1" || instances[1].Address != "10.0.0.2" {
+		t.Fatalf("Unexpected instances %+v", instances)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// templateDeps records which keys and directories a render looked at.
+type templateDeps struct {
+	keys     map[string]bool
+	prefixes map[string]bool
+
+	// What the render read from outside the mapping's prefixes.
+	external map[string]map[string]string
+}
+
+func newTemplateDeps() *templateDeps {
+	return &templateDeps{
+		keys:     make(map[string]bool),
+		prefixes: make(map[string]bool),
+		external: make(map[string]map[string]string),
+	}
+}
+
+// Returns the part of the keys that the recorded dependencies cover, so two
+// views can be compared to tell whether a render would come out different.
+func (deps *templateDeps) view(env map[string]string) map[string]string {
+	view := make(map[string]string)
+	for k, v := range env {
+		if deps.keys[k] {
+			view[k] = v
+			continue
+		}
+		for prefix := range deps.prefixes {
+			if strings.HasPrefix(k, prefix) {
+				view[k] = v
+				break
+			}
+		}
+	}
+	return view
+}
+
+// templateScope is what the key functions of a template read from.
+type templateScope struct {
+	mapping *MappingConfig
+	env     map[string]string
+	deps    *templateDeps
+
+	// Where keys outside the mapping's prefixes are looked up, if anywhere.
+	external *externalKeys
+
+	// Whether the template can call env and file.
+	localAccess bool
+
+	// What included keys are executed with, and the keys being included, to
+	// catch a key that ends up including itself.
+	data  interface{}
+	stack []string
+}
+
+// Looks a key up relative to the mapping's prefixes and, failing that, as a
+// full key in Consul.
+func (scope *templateScope) lookupKey(name string) (string, bool, error) {
+	name = strings.TrimPrefix(name, "/")
+	scope.deps.keys[name] = true
+	if v, ok := scope.env[name]; ok {
+		return v, true, nil
+	}
+	if scope.external == nil {
+		return "", false, nil
+	}
+
+	values, err := scope.external.key(name)
+	if err != nil {
+		return "", false, err
+	}
+	scope.deps.external["key:"+name] = values
+
+	v, ok := values[name]
+	return v, ok, nil
+}
+
+// Returns the keys under a directory, by their names relative to it.  The
+// mapping's own keys are used if there are any under it, otherwise the
+// directory is read from Consul.
+func (scope *templateScope) lookupTree(dir string) (map[string]string, error) {
+	dir = strings.Trim(dir, "/")
+	if dir != "" {
+		dir += "/"
+	}
+	scope.deps.prefixes[dir] = true
+
+	entries := make(map[string]string)
+	for k, v := range scope.env {
+		if strings.HasPrefix(k, dir) && k != dir {
+			entries[strings.TrimPrefix(k, dir)] = v
+		}
+	}
+	if len(entries) > 0 || dir == "" || scope.external == nil {
+		return entries, nil
+	}
+
+	values, err := scope.external.tree(dir)
+	if err != nil {
+		return nil, err
+	}
+	scope.deps.external["tree:"+dir] = values
+
+	for k, v := range values {
+		if k != dir {
+			entries[strings.TrimPrefix(k, dir)] = v
+		}
+	}
+	return entries, nil
+}
+
+// templateFile renders a mapping's template into the single file at its path.
+type templateFile struct {
+	mapping  *MappingConfig
+	tmpl     *template.Template
+	external *externalKeys
+
+	// The keys and dependencies of the last successful render.
+	env  map[string]string
+	deps *templateDeps
+}
+
+// Builds the functions a template may call.  key, keyOrDefault, ls, tree and
+// include read through the scope and record what they read in its deps.
+func templateFuncs(scope *templateScope) template.FuncMap {
+	funcs := withTemplateLibrary(template.FuncMap{
+		"key":          keyFunc(scope),
+		"keyOrDefault": keyOrDefaultFunc(scope),
+		"ls":           lsFunc(scope),
+		"tree":         treeFunc(scope),
+		"include":      includeFunc(scope),
+	})
+	if len(scope.mapping.Keystore) > 0 {
+		funcs["goDecrypt"] = goDecryptFunc(newKeyChain(scope.mapping))
+	}
+	if scope.localAccess {
+		for name, f := range localTemplateFuncs() {
+			funcs[name] = f
+		}
+	}
+	return funcs
+}
+
+func newTemplateFile(mappingConfig *MappingConfig, external *externalKeys) (*templateFile, error) {
+	funcs := templateFuncs(&templateScope{mapping: mappingConfig, deps: newTemplateDeps(), localAccess: true})
+	tmpl, err := template.New(filepath.Base(mappingConfig.Template)).Funcs(funcs).ParseFiles(mappingConfig.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	return &templateFile{
+		mapping:  mappingConfig,
+		tmpl:     tmpl,
+		external: external,
+	}, nil
+}
+
+func (t *templateFile) forget() {
+	t.deps = nil
+}
+
+// Renders the template from the given keys and writes it out.  Nothing is
+// rendered unless a key the last render used has changed, and the result
+// reports whether the file was written.
+func (t *templateFile) render(env map[string]string) (bool, error) {
+	if t.deps != nil && reflect.DeepEqual(t.deps.view(t.env), t.deps.view(env)) &&
+		(t.external == nil || !t.external.changedSince(t.deps.external)) {
+		return false, nil
+	}
+
+	scope := &templateScope{
+		mapping:     t.mapping,
+		env:         env,
+		deps:        newTemplateDeps(),
+		external:    t.external,
+		localAccess: true,
+	}
+	buff := new(bytes.Buffer)
+	if err := t.tmpl.Funcs(templateFuncs(scope)).Execute(buff, nil); err != nil {
+		return false, err
+	}
+
+	// The output holds values from Consul, so only the tags in it are
+	// decrypted; running it as a template again would run those values too.
+	data := buff.Bytes()
+	if len(t.mapping.Keystore) > 0 {
+		decrypted, err := newKeyChain(t.mapping).decryptTags(data)
+		if err != nil {
+			return false, err
+		}
+		data = decrypted
+	}
+
+	if err := writeFileAtomic(t.mapping.Path, data); err != nil {
+		return false, err
+	}
+
+	t.env = env
+	t.deps = scope.deps
+	return true, nil
+}
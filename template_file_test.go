@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	gosecret "github.com/cimpress-mcp/gosecret/api"
+)
+
+const testTemplate = `db={{key "db/host"}}:{{keyOrDefault "db/port" "5432"}}
+{{range ls "flags"}}{{.Key}}={{.Value}}
+{{end}}{{range tree "hosts"}}{{.Key}} {{.Value}}
+{{end}}`
+
+func TestTemplateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul-template")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath := path.Join(dir, "app.tmpl")
+	if err := ioutil.WriteFile(templatePath, []byte(testTemplate), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	mappingConfig := &MappingConfig{
+		Path:     path.Join(dir, "out", "app.conf"),
+		Template: templatePath,
+	}
+	renderer, err := newTemplateFile(mappingConfig, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	env := map[string]string{
+		"db/host":        "db1",
+		"flags/a":        "1",
+		"flags/nested/b": "2",
+		"hosts/web/1":    "10.0.0.1",
+		"unused":         "x",
+	}
+
+	changed, err := renderer.render(env)
+	if err != nil || !changed {
+		t.Fatalf("Expected a render, got %v %v", changed, err)
+	}
+	data, err := ioutil.ReadFile(mappingConfig.Path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "db=db1:5432\na=1\nweb/1 10.0.0.1\n"
+	if string(data) != expected {
+		t.Fatalf("Expected %q, got %q", expected, data)
+	}
+
+	// A key the template never looked at does not re-render it.
+	next := copyEnv(env)
+	next["unused"] = "y"
+	if changed, err := renderer.render(next); err != nil || changed {
+		t.Fatalf("Expected no render, got %v %v", changed, err)
+	}
+
+	// A missing key that appears does.
+	next = copyEnv(env)
+	next["db/port"] = "6543"
+	if changed, err := renderer.render(next); err != nil || !changed {
+		t.Fatalf("Expected a render, got %v %v", changed, err)
+	}
+
+	// As does a new key under a listed directory.
+	next = copyEnv(next)
+	next["hosts/web/2"] = "10.0.0.2"
+	if changed, err := renderer.render(next); err != nil || !changed {
+		t.Fatalf("Expected a render, got %v %v", changed, err)
+	}
+	data, _ = ioutil.ReadFile(mappingConfig.Path)
+	expected = "db=db1:6543\na=1\nweb/1 10.0.0.1\nweb/2 10.0.0.2\n"
+	if string(data) != expected {
+		t.Fatalf("Expected %q, got %q", expected, data)
+	}
+
+	// A required key that goes away fails the render and leaves the file alone.
+	next = copyEnv(next)
+	delete(next, "db/host")
+	if _, err := renderer.render(next); err == nil {
+		t.Fatalf("Expected an error for a missing key")
+	}
+	data, _ = ioutil.ReadFile(mappingConfig.Path)
+	if string(data) != expected {
+		t.Fatalf("Expected %q, got %q", expected, data)
+	}
+}
+
+func TestTemplateFileDecryptsOnlyTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul-template")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath := path.Join(dir, "app.tmpl")
+	ioutil.WriteFile(templatePath, []byte("{{range tree \"\"}}{{.Key}}={{.Value}}\n{{end}}"), 0644)
+
+	dt, err := gosecret.ParseEncrytionTag(testKeystore, "auth", "hunter2", "fsconsul_test_key")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tag := "[gosecret|auth|" + base64.StdEncoding.EncodeToString(dt.CipherText) + "|" +
+		base64.StdEncoding.EncodeToString(dt.InitVector) + "|fsconsul_test_key]"
+
+	os.Setenv("FSCONSUL_PROBE_SECRET", "leaked")
+	defer os.Unsetenv("FSCONSUL_PROBE_SECRET")
+
+	mappingConfig := &MappingConfig{
+		Path:     path.Join(dir, "app.conf"),
+		Template: templatePath,
+		Keystore: KeystoreDirs{testKeystore},
+	}
+	renderer, err := newTemplateFile(mappingConfig, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Values with braces in them are written as they are, not run.
+	env := map[string]string{
+		"a": "a {{ b",
+		"b": `{{ env "FSCONSUL_PROBE_SECRET" }}`,
+		"c": tag,
+	}
+	if _, err := renderer.render(env); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, _ := ioutil.ReadFile(mappingConfig.Path)
+	expected := "a=a {{ b\nb={{ env \"FSCONSUL_PROBE_SECRET\" }}\nc=hunter2\n"
+	if string(data) != expected {
+		t.Fatalf("Expected %q, got %q", expected, data)
+	}
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	copied := make(map[string]string, len(env))
+	for k, v := range env {
+		copied[k] = v
+	}
+	return copied
+}
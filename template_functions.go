@@ -1,8 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
 	gosecret "github.com/cimpress-mcp/gosecret/api"
 )
 
@@ -10,26 +23,323 @@ func goEncryptFunc(keystore string) func(...string) (string, error) {
 	return func(s ...string) (string, error) {
 		dt, err := gosecret.ParseEncrytionTag(keystore, s...)
 		if err != nil {
-			fmt.Println("Unable to parse encryption tag", err)
 			return "", err
 		}
 
-		return (fmt.Sprintf("{{goDecrypt \"%s\" \"%s\" \"%s\" \"%s\"}}",
-			dt.AuthData,
-			base64.StdEncoding.EncodeToString(dt.CipherText),
-			base64.StdEncoding.EncodeToString(dt.InitVector),
-			dt.KeyName)), nil
+		// The arguments are quoted as Go strings, which is how the template
+		// parser reads them back.
+		return (fmt.Sprintf("{{goDecrypt %s %s %s %s}}",
+			strconv.Quote(string(dt.AuthData)),
+			strconv.Quote(base64.StdEncoding.EncodeToString(dt.CipherText)),
+			strconv.Quote(base64.StdEncoding.EncodeToString(dt.InitVector)),
+			strconv.Quote(dt.KeyName))), nil
 	}
 }
 
-func goDecryptFunc(keystore string) func(...string) (string, error) {
+func goDecryptFunc(keys *keyChain) func(...string) (string, error) {
 	return func(s ...string) (string, error) {
-		plaintext, err := gosecret.ParseDecryptionTag(keystore, s...)
+		plaintext, err := keys.decrypt(s...)
 		if err != nil {
-			fmt.Println("Unable to parse encryption tag", err)
 			return "", err
 		}
 
 		return fmt.Sprintf("%s", plaintext), nil
 	}
 }
+
+// kvEntry is a key and its value, as listed by ls and tree.  Key is relative
+// to the directory that was listed.
+type kvEntry struct {
+	Key   string
+	Value string
+}
+
+// Returns the value of a key, failing the render if it is missing.
+func keyFunc(scope *templateScope) func(string) (string, error) {
+	return func(key string) (string, error) {
+		v, ok, err := scope.lookupKey(key)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("Key not found: %s", key)
+		}
+		return v, nil
+	}
+}
+
+// Returns the value of a key, or the default when it is missing.
+func keyOrDefaultFunc(scope *templateScope) func(string, string) (string, error) {
+	return func(key string, def string) (string, error) {
+		v, ok, err := scope.lookupKey(key)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return def, nil
+		}
+		return v, nil
+	}
+}
+
+// Lists the keys directly under a directory, skipping nested ones.
+func lsFunc(scope *templateScope) func(string) ([]kvEntry, error) {
+	return func(dir string) ([]kvEntry, error) {
+		all, err := treeFunc(scope)(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []kvEntry
+		for _, entry := range all {
+			if !strings.Contains(entry.Key, "/") {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	}
+}
+
+// Lists every key under a directory, sorted by key.
+func treeFunc(scope *templateScope) func(string) ([]kvEntry, error) {
+	return func(dir string) ([]kvEntry, error) {
+		values, err := scope.lookupTree(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []kvEntry
+		for k, v := range values {
+			entries = append(entries, kvEntry{k, v})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Key < entries[j].Key
+		})
+		return entries, nil
+	}
+}
+
+// Renders another key as a template, with the same functions and data, and
+// returns the result.  A key that ends up including itself fails the render.
+func includeFunc(scope *templateScope) func(string) (string, error) {
+	return func(key string) (string, error) {
+		key = strings.TrimPrefix(key, "/")
+		for _, including := range scope.stack {
+			if including == key {
+				return "", fmt.Errorf("Template cycle: %s -> %s", strings.Join(scope.stack, " -> "), key)
+			}
+		}
+
+		v, ok, err := scope.lookupKey(key)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("Key not found: %s", key)
+		}
+
+		included := *scope
+		included.localAccess = scope.mapping.AllowLocalAccess
+		included.stack = append(scope.stack[:len(scope.stack):len(scope.stack)], key)
+		tmpl, err := template.New(key).Funcs(templateFuncs(&included)).Parse(v)
+		if err != nil {
+			return "", err
+		}
+
+		buff := new(bytes.Buffer)
+		if err := tmpl.Execute(buff, scope.data); err != nil {
+			return "", err
+		}
+		return buff.String(), nil
+	}
+}
+
+// Returns the functions every template fsconsul runs can call, on top of
+// those text/template provides.  Functions that take a value to work on take
+// it last, so they can be used in pipelines.
+func templateLibrary() template.FuncMap {
+	return template.FuncMap{
+		// Strings
+		"toUpper":    strings.ToUpper,
+		"toLower":    strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       func(sep string, list []string) string { return strings.Join(list, sep) },
+		"indent":     indentFunc,
+
+		// Paths
+		"base":     path.Base,
+		"dir":      path.Dir,
+		"ext":      path.Ext,
+		"clean":    path.Clean,
+		"joinPath": path.Join,
+
+		// Encodings
+		"base64Encode": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"base64Decode": base64DecodeFunc,
+		"hexEncode":    func(s string) string { return hex.EncodeToString([]byte(s)) },
+		"hexDecode":    hexDecodeFunc,
+		"toJSON":       toJSONFunc,
+		"parseJSON":    func(s string) (interface{}, error) { return parseValue(valueFormatJSON, s) },
+		"toYAML":       toYAMLFunc,
+		"parseYAML":    func(s string) (interface{}, error) { return parseValue(valueFormatYAML, s) },
+		"sha256":       func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) },
+
+		// Quoting
+		"htmlEscape": html.EscapeString,
+		"shellQuote": shellQuoteFunc,
+
+		// The machine fsconsul runs on
+		"hostname": os.Hostname,
+
+		// Missing values
+		"default":  defaultFunc,
+		"required": requiredFunc,
+	}
+}
+
+// Returns the functions that read the files and environment of the machine
+// fsconsul runs on, for templates that don't come from Consul or whose
+// mapping allows it.
+func localTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"env":  os.Getenv,
+		"file": fileFunc,
+	}
+}
+
+// Adds the library to a set of functions, which take precedence over it.
+func withTemplateLibrary(funcs template.FuncMap) template.FuncMap {
+	merged := templateLibrary()
+	for name, f := range funcs {
+		merged[name] = f
+	}
+	return merged
+}
+
+// Prefixes every line that isn't empty with the given number of spaces.
+func indentFunc(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func base64DecodeFunc(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func hexDecodeFunc(s string) (string, error) {
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func toJSONFunc(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toYAMLFunc(v interface{}) (string, error) {
+	data, err := encodeYAML(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// Turns the json.Numbers that parseJSON and parseYAML return back into
+// numbers, which YAML would otherwise write as strings.
+func yamlNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	case keyTree:
+		converted := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			converted[k] = yamlNumbers(child)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = yamlNumbers(item)
+		}
+		return converted
+	}
+	return value
+}
+
+// Quotes a string for a POSIX shell, so it is passed as a single word.
+func shellQuoteFunc(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func fileFunc(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Returns the value, or the default when the value is empty or missing.
+func defaultFunc(def interface{}, value interface{}) interface{} {
+	if isEmptyValue(value) {
+		return def
+	}
+	return value
+}
+
+// Returns the value, failing the render with the message when it is empty or
+// missing.
+func requiredFunc(message string, value interface{}) (interface{}, error) {
+	if isEmptyValue(value) {
+		return nil, fmt.Errorf("%s", message)
+	}
+	return value, nil
+}
+
+func isEmptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case []string:
+		return len(v) == 0
+	case map[string]string:
+		return len(v) == 0
+	case keyTree:
+		return len(v) == 0
+	case bool:
+		return !v
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"text/template"
+)
+
+func executeTemplate(t *testing.T, text string) (string, error) {
+	tmpl, err := template.New("test").Funcs(withTemplateLibrary(localTemplateFuncs())).Parse(text)
+	if err != nil {
+		t.Fatalf("Could not parse %q: %v", text, err)
+	}
+
+	buff := new(bytes.Buffer)
+	err = tmpl.Execute(buff, nil)
+	return buff.String(), err
+}
+
+func TestTemplateLibrary(t *testing.T) {
+	f, err := ioutil.TempFile("", "fsconsul-file")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from a file")
+	f.Close()
+
+	os.Setenv("FSCONSUL_TEST_VAR", "set")
+	defer os.Unsetenv("FSCONSUL_TEST_VAR")
+
+	hostname, _ := os.Hostname()
+
+	tests := map[string]string{
+		`{{"Hello" | toUpper}} {{"Hello" | toLower}}`: "HELLO hello",
+		`{{trim "  x  "}}`: "x",
+		`{{"app.conf" | trimSuffix ".conf" | trimPrefix "ap"}}`:                  "p",
+		`{{"a-b-c" | replace "-" "."}}`:                                          "a.b.c",
+		`{{"a,b" | split "," | join ";"}}`:                                       "a;b",
+		`{{contains "b" "abc"}} {{hasPrefix "a" "abc"}} {{hasSuffix "a" "abc"}}`: "true true false",
+		`{{"a\nb\n" | indent 2}}`:                                                "  a\n  b\n",
+		`{{base "/etc/app/x.conf"}} {{dir "/etc/app/x.conf"}} {{ext "x.conf"}}`:  "x.conf /etc/app .conf",
+		`{{clean "/etc//app/../x"}} {{joinPath "etc" "app"}}`:                    "/etc/x etc/app",
+		`{{"secret" | base64Encode}} {{"c2VjcmV0" | base64Decode}}`:              "c2VjcmV0 secret",
+		`{{"hi" | hexEncode}} {{"6869" | hexDecode}}`:                            "6869 hi",
+		`{{"abc" | sha256}}`:                                                     "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		`{{(parseJSON "{\"a\": [1, 2]}").a | toJSON}}`:                           "[1,2]",
+		`{{(parseYAML "a: 1\nb: x") | toYAML}}`:                                  "a: 1\nb: x",
+		`{{htmlEscape "<a href='x'>&</a>"}}`:                                     "&lt;a href=&#39;x&#39;&gt;&amp;&lt;/a&gt;",
+		`{{shellQuote "it's"}}`:                                                  `'it'\''s'`,
+		`{{env "FSCONSUL_TEST_VAR"}}`:                                            "set",
+		`{{file "` + f.Name() + `"}}`:                                            "from a file",
+		`{{hostname}}`:                                                           hostname,
+		`{{"" | default "fallback"}} {{"value" | default "fallback"}}`:           "fallback value",
+		`{{"value" | required "needed"}}`:                                        "value",
+	}
+
+	for text, expected := range tests {
+		out, err := executeTemplate(t, text)
+		if err != nil {
+			t.Fatalf("Could not execute %q: %v", text, err)
+		}
+		if out != expected {
+			t.Fatalf("%q: expected %q, got %q", text, expected, out)
+		}
+	}
+}
+
+func TestTemplateLibraryErrors(t *testing.T) {
+	for _, text := range []string{
+		`{{"" | required "db host is required"}}`,
+		`{{"%%%" | base64Decode}}`,
+		`{{"zz" | hexDecode}}`,
+		`{{parseJSON "{"}}`,
+		`{{file "/does/not/exist"}}`,
+	} {
+		if _, err := executeTemplate(t, text); err == nil {
+			t.Fatalf("Expected an error from %q", text)
+		}
+	}
+}
+
+func TestGoSecretFuncErrors(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	keys := newKeyChain(&MappingConfig{Keystore: KeystoreDirs{testKeystore}})
+	if _, err := goEncryptFunc(testKeystore)("auth", "secret", "missing_key"); err == nil {
+		t.Fatalf("Expected an error for a missing key")
+	}
+	if _, err := goDecryptFunc(keys)("auth", "YQ==", "Yg==", "missing_key"); err == nil {
+		t.Fatalf("Expected an error for a missing key")
+	}
+
+	// Errors are returned to the caller, not printed over the output.
+	w.Close()
+	os.Stdout = stdout
+	if printed, _ := ioutil.ReadAll(r); len(printed) > 0 {
+		t.Fatalf("Expected nothing on stdout, got %q", printed)
+	}
+}
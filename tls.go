@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Turns a version such as "1.2" into its crypto/tls constant.  An empty
+// version leaves the choice to crypto/tls.
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+
+	parsed, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("Unknown TLS version: %s", version)
+	}
+	return parsed, nil
+}
+
+// Turns a comma-separated list of cipher suite names, as printed by
+// crypto/tls, into their IDs.  An empty list leaves the choice to crypto/tls.
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Builds a pool from a CA certificate file and/or a directory of them.
+func loadCertPool(caFile string, caPath string) (*x509.CertPool, error) {
+	certPool := x509.NewCertPool()
+
+	var files []string
+	if caFile != "" {
+		files = append(files, caFile)
+	}
+	if caPath != "" {
+		entries, err := ioutil.ReadDir(caPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(caPath, entry.Name()))
+			}
+		}
+	}
+
+	for _, file := range files {
+		if data, err := ioutil.ReadFile(file); err != nil {
+			return nil, err
+		} else if !certPool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Invalid certificate file: %s", file)
+		}
+	}
+
+	return certPool, nil
+}
+
+// certReloader hands out the client certificate and CA pool for a Consul
+// connection, loading them again whenever their files change on disk.
+type certReloader struct {
+	consulConfig ConsulConfig
+	serverName   string
+
+	lock            sync.Mutex
+	cert            *tls.Certificate
+	certFingerprint string
+	roots           *x509.CertPool
+	rootFingerprint string
+}
+
+// Loads the certificate and CAs up front, so that broken files are still
+// reported when the client is built.
+func newCertReloader(consulConfig ConsulConfig) (*certReloader, error) {
+	reloader := &certReloader{
+		consulConfig: consulConfig,
+		serverName:   expectedServerName(consulConfig),
+	}
+
+	if consulConfig.CertFile != "" && consulConfig.KeyFile != "" {
+		if err := reloader.reloadCert(); err != nil {
+			return nil, err
+		}
+	}
+
+	if consulConfig.CAFile != "" || consulConfig.CAPath != "" {
+		if err := reloader.reloadRoots(); err != nil {
+			return nil, err
+		}
+	}
+
+	return reloader, nil
+}
+
+// Works out the name the agent's certificate must be valid for: the configured
+// server name, or else the host we connect to.  The negotiated SNI can't be
+// used, since it is left empty for IP addresses.
+func expectedServerName(consulConfig ConsulConfig) string {
+	if consulConfig.TLSServerName != "" {
+		return consulConfig.TLSServerName
+	}
+
+	addr := consulConfig.Addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		addr = addr[i+3:]
+	}
+	addr = strings.SplitN(addr, "/", 2)[0]
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Summarises the size and modification time of the given files and of those
+// in the given directory, so changes can be spotted without reading them.
+func fingerprintFiles(files []string, dir string) string {
+	if dir != "" {
+		files = append(files, dir)
+		if entries, err := ioutil.ReadDir(dir); err == nil {
+			for _, entry := range entries {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	var fingerprint bytes.Buffer
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&fingerprint, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return fingerprint.String()
+}
+
+// Must be called with the lock held, or before the reloader is shared.
+func (reloader *certReloader) reloadCert() error {
+	fingerprint := fingerprintFiles([]string{reloader.consulConfig.CertFile, reloader.consulConfig.KeyFile}, "")
+	if reloader.cert != nil && fingerprint == reloader.certFingerprint {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.consulConfig.CertFile, reloader.consulConfig.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if reloader.cert != nil {
+		log.WithFields(log.Fields{
+			"file": reloader.consulConfig.CertFile,
+		}).Info("Client certificate changed, using the new one")
+	}
+
+	reloader.cert = &cert
+	reloader.certFingerprint = fingerprint
+	return nil
+}
+
+// Must be called with the lock held, or before the reloader is shared.
+func (reloader *certReloader) reloadRoots() error {
+	fingerprint := fingerprintFiles([]string{reloader.consulConfig.CAFile}, reloader.consulConfig.CAPath)
+	if reloader.roots != nil && fingerprint == reloader.rootFingerprint {
+		return nil
+	}
+
+	roots, err := loadCertPool(reloader.consulConfig.CAFile, reloader.consulConfig.CAPath)
+	if err != nil {
+		return err
+	}
+
+	if reloader.roots != nil {
+		log.WithFields(log.Fields{
+			"file": reloader.consulConfig.CAFile,
+			"path": reloader.consulConfig.CAPath,
+		}).Info("CA certificates changed, using the new ones")
+	}
+
+	reloader.roots = roots
+	reloader.rootFingerprint = fingerprint
+	return nil
+}
+
+// Used as tls.Config.GetClientCertificate.  A certificate that fails to load
+// mid-rotation (e.g. the key was written before the certificate) is not fatal;
+// we keep presenting the last good one.
+func (reloader *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	if err := reloader.reloadCert(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to reload client certificate, keeping the current one")
+	}
+	return reloader.cert, nil
+}
+
+// Used as tls.Config.VerifyConnection to check the agent's certificate chain
+// against the current CA pool.
+func (reloader *certReloader) verifyConnection(state tls.ConnectionState) error {
+	reloader.lock.Lock()
+	if err := reloader.reloadRoots(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Failed to reload CA certificates, keeping the current ones")
+	}
+	roots := reloader.roots
+	reloader.lock.Unlock()
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("Consul agent presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       reloader.serverName,
+	})
+	return err
+}
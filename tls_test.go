@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for version, expected := range map[string]uint16{
+		"":       0,
+		"1.2":    tls.VersionTLS12,
+		"TLS1.3": tls.VersionTLS13,
+	} {
+		actual, err := parseTLSVersion(version)
+		if err != nil || actual != expected {
+			t.Errorf("parseTLSVersion(%q) = %v, %v, expected %v", version, actual, err, expected)
+		}
+	}
+
+	if _, err := parseTLSVersion("2.0"); err == nil {
+		t.Error("Expected an error for an unknown TLS version")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if !reflect.DeepEqual(suites, expected) {
+		t.Fatalf("Parsed %v, expected %v", suites, expected)
+	}
+
+	if _, err := parseCipherSuites("TLS_MADE_UP"); err == nil {
+		t.Fatal("Expected an error for an unknown cipher suite")
+	}
+}
+
+func TestLoadCertPoolFromPath(t *testing.T) {
+	if _, err := loadCertPool("", "test_data/ks"); err == nil {
+		t.Fatal("Expected an error for a directory holding something other than certificates")
+	}
+
+	if _, err := loadCertPool("test_data/ca.cert", ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTLSSkipVerifyAndMinVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[]`)
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	consulConfig := ConsulConfig{Addr: server.Listener.Addr().String(), UseTLS: true}
+
+	client, err := buildConsulClient(consulConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := client.KV().List("tls", nil); err == nil {
+		t.Fatal("Expected the self-signed test certificate to be rejected")
+	}
+
+	consulConfig.TLSSkipVerify = true
+	if client, err = buildConsulClient(consulConfig); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := client.KV().List("tls", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	consulConfig.TLSMinVersion = "1.3"
+	if client, err = buildConsulClient(consulConfig); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := client.KV().List("tls", nil); err == nil {
+		t.Fatal("Expected a TLS 1.2 agent to be rejected with a 1.3 minimum")
+	}
+}
+
+func writeCertificate(t *testing.T, file string, cert *x509.Certificate) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// Swap the CA file under a live client and check that the agent's certificate
+// is verified against the new one.
+func TestCAReload(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[]`)
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := path.Join(dir, "ca.pem")
+	writeCertificate(t, caFile, server.Certificate())
+
+	consulConfig := ConsulConfig{Addr: server.Listener.Addr().String(), UseTLS: true, CAFile: caFile}
+	client, err := buildConsulClient(consulConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := client.KV().List("tls", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	consulConfig.TLSServerName = "consul.invalid"
+	misnamed, err := buildConsulClient(consulConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, _, err := misnamed.KV().List("tls", nil); err == nil {
+		t.Fatal("Expected a certificate for the wrong server name to be rejected")
+	}
+
+	// Replace the CA with one that did not sign the agent's certificate.  The
+	// size alone would not tell us it changed, so move the mtime along too.
+	otherCA, err := ioutil.ReadFile("test_data/ca.cert")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(caFile, otherCA, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(caFile, later, later)
+	server.CloseClientConnections()
+
+	if _, _, err := client.KV().List("tls", nil); err == nil {
+		t.Fatal("Expected the agent to be rejected once its CA was rotated out")
+	}
+}
+
+func TestExpectedServerName(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"127.0.0.1:8501":              "127.0.0.1",
+		"https://consul.local:8501":   "consul.local",
+		"https://consul.local/prefix": "consul.local",
+		"[::1]:8501":                  "::1",
+		"consul.local":                "consul.local",
+	} {
+		if actual := expectedServerName(ConsulConfig{Addr: addr}); actual != expected {
+			t.Errorf("expectedServerName(%q) = %q, expected %q", addr, actual, expected)
+		}
+	}
+}
+
+// Generates a throwaway self-signed certificate and key, PEM encoded.
+func generateKeyPair(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := path.Join(dir, "agent.cert")
+	keyFile := path.Join(dir, "agent.key")
+	write := func(name string, modTime time.Time) {
+		cert, key := generateKeyPair(t, name)
+		for file, data := range map[string][]byte{certFile: cert, keyFile: key} {
+			if err := ioutil.WriteFile(file, data, 0600); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			os.Chtimes(file, modTime, modTime)
+		}
+	}
+	commonName := func(reloader *certReloader) string {
+		cert, err := reloader.clientCertificate(nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	now := time.Now()
+	write("first", now.Add(-time.Hour))
+
+	reloader, err := newCertReloader(ConsulConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if name := commonName(reloader); name != "first" {
+		t.Fatalf("Expected the first certificate, got %q", name)
+	}
+
+	write("second", now)
+	if name := commonName(reloader); name != "second" {
+		t.Fatalf("Expected the rotated certificate, got %q", name)
+	}
+
+	// A half-written rotation keeps the last good certificate.
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	if name := commonName(reloader); name != "second" {
+		t.Fatalf("Expected to keep the last good certificate, got %q", name)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// tokenSource hands out the ACL token used by a watch.  A token read from a
+// file is read again whenever the file changes, so rotated tokens are picked
+// up by running watches without a restart.
+type tokenSource struct {
+	lock    sync.Mutex
+	token   string
+	file    string
+	modTime time.Time
+}
+
+// Resolves the token the same way the Consul CLI does: a token file wins over
+// a token.
+func newTokenSource(consulConfig ConsulConfig) *tokenSource {
+	return &tokenSource{
+		token: consulConfig.Token,
+		file:  consulConfig.TokenFile,
+	}
+}
+
+// Returns the current token, reading the token file again if it changed since
+// the last read.
+func (source *tokenSource) Token() string {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	if source.file == "" {
+		return source.token
+	}
+
+	info, err := os.Stat(source.file)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  source.file,
+		}).Warn("Failed to check token file, keeping the current token")
+		return source.token
+	}
+
+	if info.ModTime().Equal(source.modTime) {
+		return source.token
+	}
+
+	data, err := ioutil.ReadFile(source.file)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  source.file,
+		}).Warn("Failed to read token file, keeping the current token")
+		return source.token
+	}
+
+	if !source.modTime.IsZero() {
+		log.WithFields(log.Fields{
+			"file": source.file,
+		}).Info("Token file changed, using the new token")
+	}
+
+	source.token = strings.TrimSpace(string(data))
+	source.modTime = info.ModTime()
+	return source.token
+}
+
+// Makes the next call to Token read the token file even if it does not look
+// like it changed, e.g. because Consul just rejected the token.
+func (source *tokenSource) invalidate() {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	source.modTime = time.Time{}
+}
+
+// Reports whether Consul refused a request because of its ACL token.
+func isPermissionDenied(err error) bool {
+	statusErr, ok := err.(consulapi.StatusError)
+	return ok && statusErr.Code == http.StatusForbidden
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func writeTokenFile(t *testing.T, file, token string, modTime time.Time) {
+	if err := ioutil.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTokenFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "token")
+	modTime := time.Now().Add(-time.Hour)
+	writeTokenFile(t, file, "first", modTime)
+
+	tokens := newTokenSource(ConsulConfig{Token: "ignored", TokenFile: file})
+	if token := tokens.Token(); token != "first" {
+		t.Fatalf("Expected token from file, got %q", token)
+	}
+
+	writeTokenFile(t, file, "second", modTime.Add(time.Minute))
+	if token := tokens.Token(); token != "second" {
+		t.Fatalf("Expected rotated token, got %q", token)
+	}
+}
+
+// A token rotated without its file looking changed is still picked up once
+// Consul rejects the old one.
+func TestTokenReadAgainOnPermissionDenied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "second" {
+			http.Error(w, "ACL not found", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[{"Key":"secret/entry","Value":"dmFsdWU="}]`)
+	}))
+	defer server.Close()
+
+	client, err := buildConsulClient(ConsulConfig{Addr: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "token")
+	modTime := time.Now().Add(-time.Hour)
+	writeTokenFile(t, file, "first", modTime)
+
+	tokens := newTokenSource(ConsulConfig{TokenFile: file})
+	query := kvListQuery("secret")
+	if _, _, err := runQuery(client, "secret", query, tokens, consulapi.QueryOptions{}); !isPermissionDenied(err) {
+		t.Fatalf("Expected permission denied, got %v", err)
+	}
+
+	writeTokenFile(t, file, "second", modTime)
+	result, _, err := runQuery(client, "secret", query, tokens, consulapi.QueryOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pairs := result.(consulapi.KVPairs)
+	if len(pairs) != 1 || string(pairs[0].Value) != "value" {
+		t.Fatalf("Unexpected pairs %v", pairs)
+	}
+}
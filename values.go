@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Formats a mapping can parse its values as.
+const (
+	valueFormatJSON = "json"
+	valueFormatYAML = "yaml"
+)
+
+// Parses a value into a document made of keyTrees, lists and scalars.  Numbers
+// are kept as json.Number so they are written back exactly as they were read,
+// and never as strings.
+func parseValue(valueFormat string, v string) (interface{}, error) {
+	var doc interface{}
+	switch valueFormat {
+	case valueFormatJSON:
+		decoder := json.NewDecoder(strings.NewReader(v))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, fmt.Errorf("Unexpected data after the value")
+		}
+	case valueFormatYAML:
+		if err := yaml.Unmarshal([]byte(v), &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown value format: %s", valueFormat)
+	}
+
+	return normalizeValue(doc)
+}
+
+// Brings what the JSON and YAML decoders return down to the same few types:
+// keyTree, []interface{}, string, json.Number, bool and nil.
+func normalizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool, json.Number:
+		return v, nil
+	case map[string]interface{}:
+		tree := make(keyTree, len(v))
+		for k, child := range v {
+			normalized, err := normalizeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			tree[k] = normalized
+		}
+		return tree, nil
+	case map[interface{}]interface{}:
+		tree := make(keyTree, len(v))
+		for k, child := range v {
+			normalized, err := normalizeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			tree[fmt.Sprint(k)] = normalized
+		}
+		return tree, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = normalized
+		}
+		return list, nil
+	case int:
+		return json.Number(strconv.Itoa(v)), nil
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), nil
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10)), nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return nil, fmt.Errorf("Unsupported number: %v", v)
+		}
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64)), nil
+	}
+
+	// Anything else, such as a YAML timestamp, is kept as its text.
+	return fmt.Sprint(value), nil
+}
+
+// Calls f for every scalar under a value, in key order, with the path to it.
+// List items are named by their index.
+func walkValue(path []string, value interface{}, f func(path []string, value interface{})) {
+	switch v := value.(type) {
+	case keyTree:
+		for _, k := range v.sortedKeys() {
+			walkValue(append(path[:len(path):len(path)], k), v[k], f)
+		}
+	case []interface{}:
+		for i, item := range v {
+			walkValue(append(path[:len(path):len(path)], strconv.Itoa(i)), item, f)
+		}
+	default:
+		f(path, v)
+	}
+}
+
+// Writes a scalar as text: strings as they are, numbers as they were read,
+// booleans as true or false and null as nothing.
+func scalarString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// Parses a mapping's values and expands each one into a key per scalar, so a
+// key holding a document is written as a directory of files.  Without a value
+// format the keys are returned as they are.
+func explodeValues(mappingConfig *MappingConfig, env map[string]string) (map[string]string, error) {
+	if mappingConfig.ValueFormat == "" {
+		return env, nil
+	}
+
+	tree, err := buildKeyTree(env, mappingConfig.ValueFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	exploded := make(map[string]string)
+	tree.walk(nil, func(path []string, value interface{}) {
+		exploded[strings.Join(path, "/")] = scalarString(value)
+	})
+	return exploded, nil
+}
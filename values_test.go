@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	expected := keyTree{
+		"name":    "app",
+		"port":    jsonNumber("5432"),
+		"ratio":   jsonNumber("0.5"),
+		"debug":   true,
+		"missing": nil,
+		"hosts":   []interface{}{"a", "b"},
+	}
+
+	for format, value := range map[string]string{
+		valueFormatJSON: `{"name": "app", "port": 5432, "ratio": 0.5, "debug": true, "missing": null, "hosts": ["a", "b"]}`,
+		valueFormatYAML: "name: app\nport: 5432\nratio: 0.5\ndebug: true\nmissing: null\nhosts:\n  - a\n  - b\n",
+	} {
+		doc, err := parseValue(format, value)
+		if err != nil {
+			t.Fatalf("%s: err: %v", format, err)
+		}
+		if !reflect.DeepEqual(doc, expected) {
+			t.Fatalf("%s: expected %#v, got %#v", format, expected, doc)
+		}
+	}
+
+	for format, value := range map[string]string{
+		valueFormatJSON: `{"name": `,
+		valueFormatYAML: "name: [app",
+		"xml":           "<name/>",
+	} {
+		if _, err := parseValue(format, value); err == nil {
+			t.Fatalf("%s: expected an error for %q", format, value)
+		}
+	}
+
+	if _, err := parseValue(valueFormatJSON, `{} {}`); err == nil {
+		t.Fatalf("Expected an error for trailing data")
+	}
+}
+
+func TestExplodeValues(t *testing.T) {
+	mappingConfig := &MappingConfig{ValueFormat: valueFormatJSON}
+	env := map[string]string{
+		"app/config": `{"db": {"host": "db1", "port": 5432}, "hosts": ["a", "b"], "debug": false}`,
+		"version":    `"1.2"`,
+	}
+
+	exploded, err := explodeValues(mappingConfig, env)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := map[string]string{
+		"app/config/db/host": "db1",
+		"app/config/db/port": "5432",
+		"app/config/hosts/0": "a",
+		"app/config/hosts/1": "b",
+		"app/config/debug":   "false",
+		"version":            "1.2",
+	}
+	if !reflect.DeepEqual(exploded, expected) {
+		t.Fatalf("Expected %v, got %v", expected, exploded)
+	}
+
+	env["version"] = "v1.2"
+	if _, err := explodeValues(mappingConfig, env); err == nil {
+		t.Fatalf("Expected an error for a value that isn't JSON")
+	}
+}
+
+func TestRenderFormatParsedValues(t *testing.T) {
+	env := map[string]string{
+		"config": "port: 5432\ndebug: true\nname: app\nhosts: [a, b]\n",
+	}
+
+	expected := map[string]string{
+		outputFormatJSON: `{
+  "config": {
+    "debug": true,
+    "hosts": [
+      "a",
+      "b"
+    ],
+    "name": "app",
+    "port": 5432
+  }
+}
+`,
+		outputFormatYAML: `config:
+  debug: true
+  hosts:
+    - a
+    - b
+  name: app
+  port: 5432
+`,
+		outputFormatTOML: `[config]
+debug = true
+hosts = ["a", "b"]
+name = "app"
+port = 5432
+`,
+		outputFormatProperties: `config.debug=true
+config.hosts.0=a
+config.hosts.1=b
+config.name=app
+config.port=5432
+`,
+	}
+
+	for format, want := range expected {
+		data, err := renderFormat(format, valueFormatYAML, env)
+		if err != nil {
+			t.Fatalf("%s: err: %v", format, err)
+		}
+		if string(data) != want {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", format, want, data)
+		}
+	}
+}
+
+func jsonNumber(s string) interface{} {
+	doc, _ := parseValue(valueFormatJSON, s)
+	return doc
+}
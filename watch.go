@@ -1,24 +1,23 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"reflect"
+	"sort"
 	"strings"
-	"text/template"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/armed/mkdirp"
 	consulapi "github.com/hashicorp/consul/api"
-
-	gosecret "github.com/cimpress-mcp/gosecret/api"
 )
 
 func init() {
@@ -31,10 +30,45 @@ type ConsulConfig struct {
 	DC    string
 	Token string
 
+	// TokenFile holds the ACL token and is read again whenever it changes.
+	TokenFile string
+
+	// Namespace and Partition scope every query on Consul Enterprise.
+	Namespace string
+	Partition string
+
 	KeyFile  string
 	CertFile string
 	CAFile   string
 	UseTLS   bool
+
+	// CAPath is a directory of CA certificates to trust, alongside CAFile.
+	CAPath string
+
+	// TLSServerName is the name expected on the agent's certificate, when it
+	// differs from the host in Addr.
+	TLSServerName string
+
+	// TLSMinVersion is the lowest TLS version to accept, e.g. "1.2", and
+	// TLSCipherSuites a comma-separated list of allowed cipher suite names.
+	TLSMinVersion   string
+	TLSCipherSuites string
+
+	// TLSSkipVerify disables verification of the agent's certificate.  Only
+	// ever use this in a lab.
+	TLSSkipVerify bool
+
+	// HTTPAuth holds "username:password" for agents behind an authenticating
+	// proxy, or HTTPAuthFile names a file holding them.
+	HTTPAuth     string
+	HTTPAuthFile string
+
+	// Headers are added to every request sent to Consul.
+	Headers map[string]string
+
+	// Proxy is the URL of an HTTP(S) proxy to reach Consul through.  Without
+	// one, the usual HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables apply.
+	Proxy string
 }
 
 // MappingConfig holds configuration for all mappings from KV to fs managed by this process.
@@ -43,7 +77,89 @@ type MappingConfig struct {
 	OnChangeRaw string `json:"onchange"`
 	Prefix      string
 	Path        string
-	Keystore    string
+
+	// Keystore lists directories of keys used to decrypt values, searched in
+	// order.  KeyAliases gives, for a key name used in encrypted tags, other
+	// key names to try when that key is missing or can't decrypt a value, so
+	// values stay readable while keys are renamed or rotated.
+	Keystore   KeystoreDirs
+	KeyAliases map[string][]string
+
+	// Decryption picks how values are decrypted: "gosecret" tags with the keys
+	// in Keystore, whole values encrypted with "age" for one of the X25519
+	// identities in the AgeIdentities files, ASCII-armored "openpgp" messages
+	// for the secret keys in the PGPKeyring files, unlocked with the passphrase
+	// in PGPPassphraseFile, or "envelope" values whose data keys KMS unwraps.
+	// By default each value is decrypted according to its header.
+	Decryption        string
+	AgeIdentities     []string
+	PGPKeyring        []string
+	PGPPassphraseFile string
+	KMS               *KMSConfig
+
+	// Prefixes lists further prefixes layered on top of Prefix, in increasing
+	// order of precedence.
+	Prefixes []string
+
+	// DeleteMarker is the value that, when found in a layer, removes the key
+	// set by the layers beneath it.
+	DeleteMarker string
+
+	// Consul optionally overrides the global Consul settings for this mapping.
+	Consul *ConsulConfig
+
+	// DCs lists datacenters to read the prefixes from.  For "failover" (the
+	// default) the first is preferred; for "merge" later ones win.
+	DCs    []string
+	DCMode string
+
+	// Namespace and Partition override the Consul ones for this mapping.
+	Namespace string
+	Partition string
+
+	// Service, when set, makes this mapping render the instances of a Consul
+	// service into the file at Path instead of writing keys.  Instances can be
+	// limited to those with all of ServiceTags, and ServiceHealth ("passing",
+	// the default, or "any") picks which instances count.  ServiceFormat is
+	// "json" (the default), "hosts" or "template", the latter rendering the Go
+	// template in ServiceTemplate.
+	Service         string
+	ServiceTags     []string
+	ServiceHealth   string
+	ServiceFormat   string
+	ServiceTemplate string
+
+	// Template, when set, names a Go template that is rendered from the keys
+	// under the mapping's prefixes into the single file at Path.
+	Template string
+
+	// Format, when set, serialises the keys under the mapping's prefixes,
+	// nested by "/", into the single file at Path.  It is one of "json",
+	// "yaml", "toml", "dotenv", "properties" or "ini".
+	Format string
+
+	// ValueFormat, when set, parses every value as "json" or "yaml".  Each
+	// document is expanded into a directory of files, one per scalar, or nested
+	// under its key when there is a Format.
+	ValueFormat string
+
+	// KeyTemplates, when set, renders keys whose names end in TemplateSuffix
+	// (".tmpl" by default) as Go templates, writing them without the suffix.
+	KeyTemplates   bool
+	TemplateSuffix string
+
+	// AllowLocalAccess lets templates that come from Consul, key templates
+	// and included keys, call env and file and see .Env.  It is off by
+	// default, so that writing to Consul doesn't give access to the files
+	// and environment fsconsul can read.
+	AllowLocalAccess bool
+
+	// OnError decides what happens when a key or file fails to render or
+	// decrypt: "skip" (the default) leaves that file as it was and writes the
+	// rest, "fail" leaves every file as it was, and "placeholder" writes
+	// ErrorPlaceholder in its place.  Either way a -once run exits non-zero.
+	OnError          string
+	ErrorPlaceholder string
 }
 
 // WatchConfig holds fsconsul configuration
@@ -54,31 +170,241 @@ type WatchConfig struct {
 }
 
 func applyDefaults(config *WatchConfig) {
+	applyEnvironment(&config.Consul)
+
 	if config.Consul.Addr == "" {
 		config.Consul.Addr = "127.0.0.1:8500"
 	}
 }
 
+// Fills in whatever the flags and config file leave empty from the standard
+// CONSUL_* environment variables, as read by the Consul API client.
+func applyEnvironment(consulConfig *ConsulConfig) {
+	env := consulapi.DefaultConfig()
+
+	if consulConfig.Addr == "" {
+		consulConfig.Addr = env.Address
+	}
+	if env.Scheme == "https" {
+		consulConfig.UseTLS = true
+	}
+	if consulConfig.Token == "" && consulConfig.TokenFile == "" {
+		consulConfig.Token = env.Token
+		consulConfig.TokenFile = env.TokenFile
+	}
+	if consulConfig.CAFile == "" {
+		consulConfig.CAFile = env.TLSConfig.CAFile
+	}
+	if consulConfig.CAPath == "" {
+		consulConfig.CAPath = env.TLSConfig.CAPath
+	}
+	if env.TLSConfig.InsecureSkipVerify {
+		consulConfig.TLSSkipVerify = true
+	}
+	if consulConfig.CertFile == "" {
+		consulConfig.CertFile = env.TLSConfig.CertFile
+	}
+	if consulConfig.KeyFile == "" {
+		consulConfig.KeyFile = env.TLSConfig.KeyFile
+	}
+	if consulConfig.TLSServerName == "" {
+		consulConfig.TLSServerName = env.TLSConfig.Address
+	}
+	if consulConfig.Namespace == "" {
+		consulConfig.Namespace = env.Namespace
+	}
+	if consulConfig.Partition == "" {
+		consulConfig.Partition = env.Partition
+	}
+	if consulConfig.HTTPAuth == "" && consulConfig.HTTPAuthFile == "" && env.HttpAuth != nil {
+		consulConfig.HTTPAuth = env.HttpAuth.Username + ":" + env.HttpAuth.Password
+	}
+}
+
+// Value that marks a key as deleted by a higher layer, unless a mapping
+// chooses its own.
+const defaultDeleteMarker = "fsconsul:delete"
+
+// What a mapping does when a key or file fails to render.
+const (
+	onErrorSkip        = "skip"
+	onErrorFail        = "fail"
+	onErrorPlaceholder = "placeholder"
+)
+
+// Ways a mapping can combine the same prefix read from several datacenters.
+const (
+	dcModeFailover = "failover"
+	dcModeMerge    = "merge"
+)
+
+// Overlays the non-empty fields of a mapping's Consul settings on top of the
+// global ones, adding to the global headers.  UseTLS and TLSSkipVerify can only
+// be switched on by a mapping, never off.
+func resolveConsulConfig(global ConsulConfig, override *ConsulConfig) ConsulConfig {
+	resolved := global
+	if override == nil {
+		return resolved
+	}
+
+	if override.Addr != "" {
+		resolved.Addr = override.Addr
+	}
+	if override.DC != "" {
+		resolved.DC = override.DC
+	}
+	if override.Token != "" {
+		resolved.Token = override.Token
+		resolved.TokenFile = ""
+	}
+	if override.TokenFile != "" {
+		resolved.TokenFile = override.TokenFile
+	}
+	if override.Namespace != "" {
+		resolved.Namespace = override.Namespace
+	}
+	if override.Partition != "" {
+		resolved.Partition = override.Partition
+	}
+	if override.KeyFile != "" {
+		resolved.KeyFile = override.KeyFile
+	}
+	if override.CertFile != "" {
+		resolved.CertFile = override.CertFile
+	}
+	if override.CAFile != "" {
+		resolved.CAFile = override.CAFile
+	}
+	if override.UseTLS {
+		resolved.UseTLS = true
+	}
+	if override.CAPath != "" {
+		resolved.CAPath = override.CAPath
+	}
+	if override.TLSServerName != "" {
+		resolved.TLSServerName = override.TLSServerName
+	}
+	if override.TLSMinVersion != "" {
+		resolved.TLSMinVersion = override.TLSMinVersion
+	}
+	if override.TLSCipherSuites != "" {
+		resolved.TLSCipherSuites = override.TLSCipherSuites
+	}
+	if override.TLSSkipVerify {
+		resolved.TLSSkipVerify = true
+	}
+	if override.HTTPAuth != "" {
+		resolved.HTTPAuth = override.HTTPAuth
+		resolved.HTTPAuthFile = ""
+	}
+	if override.HTTPAuthFile != "" {
+		resolved.HTTPAuthFile = override.HTTPAuthFile
+	}
+	if len(override.Headers) > 0 {
+		resolved.Headers = make(map[string]string)
+		for name, value := range global.Headers {
+			resolved.Headers[name] = value
+		}
+		for name, value := range override.Headers {
+			resolved.Headers[name] = value
+		}
+	}
+	if override.Proxy != "" {
+		resolved.Proxy = override.Proxy
+	}
+
+	return resolved
+}
+
 // Queue watchers
 func watchAndExec(config *WatchConfig) int {
 
 	applyDefaults(config)
 
+	for i := 0; i < len(config.Mappings); i++ {
+		normalizeMapping(&config.Mappings[i])
+
+		log.WithFields(log.Fields{
+			"config": config.Mappings[i],
+		}).Debug("Got mapping config")
+	}
+
 	returnCodes := make(chan int)
 
+	// Share one client between all watches using the same Consul settings.
+	clients := &clientCache{}
+
 	// Fork a separate goroutine for each prefix/path pair
+	var feeds []*mappingFeed
+	var services []*MappingConfig
 	for i := 0; i < len(config.Mappings); i++ {
-		go func(mappingConfig *MappingConfig) {
+		if config.Mappings[i].Service != "" {
+			services = append(services, &config.Mappings[i])
+			continue
+		}
+
+		feed := newMappingFeed(&config.Mappings[i], mappingLayers(config.Consul, &config.Mappings[i]))
+		feeds = append(feeds, feed)
 
-			if mappingConfig.OnChangeRaw != "" {
-				mappingConfig.OnChange = strings.Split(mappingConfig.OnChangeRaw, " ")
+		// Templates may refer to keys outside the mapping's prefixes, which are
+		// read through the mapping's own Consul settings.
+		if usesTemplates(feed.mapping) {
+			candidates := mappingCandidates(config.Consul, feed.mapping)
+			mappingClients, err := buildConsulClients(clients, candidates)
+			if err != nil {
+				feed.fail(err)
+			} else {
+				feed.external = newExternalKeys(mappingClients, candidates[0])
+			}
+		}
+
+		go func(feed *mappingFeed) {
+			defer close(feed.doneCh)
+			if feed.external != nil {
+				defer feed.external.close()
 			}
 
-			log.WithFields(log.Fields{
-				"config": mappingConfig,
-			}).Debug("Got mapping config")
+			returnCode, err := watchMappingAndExec(config, feed)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Debug("Failure from watch function")
+			}
+
+			returnCodes <- returnCode
+		}(feed)
+	}
+
+	// Run a single blocking query for each group of overlapping prefixes.
+	for _, group := range planWatches(feeds) {
+		groupClients, err := buildConsulClients(clients, group.consul)
+		if err != nil {
+			for _, sub := range group.subscriptions {
+				sub.feed.fail(err)
+			}
+			continue
+		}
+
+		// Key templates can refer to the node they are rendered for, so look it
+		// up before the first keys arrive.
+		for _, sub := range group.subscriptions {
+			if sub.feed.mapping.KeyTemplates && sub.feed.node() == nil {
+				sub.feed.setNode(lookupNode(groupClients[0], newTokenSource(group.consul[0]).Token()))
+			}
+		}
+
+		go runWatchGroup(groupClients, group)
+	}
 
-			returnCode, err := watchMappingAndExec(config, mappingConfig)
+	// Services have a watch of their own, since they don't share prefixes.
+	for _, mappingConfig := range services {
+		serviceClients, err := buildConsulClients(clients, mappingCandidates(config.Consul, mappingConfig))
+
+		go func(mappingConfig *MappingConfig, serviceClients []*consulapi.Client) {
+			returnCode := 0
+			if err == nil {
+				returnCode, err = watchServiceAndExec(config, mappingConfig, serviceClients)
+			}
 			if err != nil {
 				log.WithFields(log.Fields{
 					"error": err,
@@ -86,7 +412,7 @@ func watchAndExec(config *WatchConfig) int {
 			}
 
 			returnCodes <- returnCode
-		}(&config.Mappings[i])
+		}(mappingConfig, serviceClients)
 	}
 
 	// Wait for completion of all forked go routines
@@ -106,29 +432,179 @@ func watchAndExec(config *WatchConfig) int {
 	return 0
 }
 
+// Returns the prefixes a mapping reads from, lowest precedence first.
+func mappingPrefixes(mappingConfig *MappingConfig) []string {
+	return append([]string{mappingConfig.Prefix}, mappingConfig.Prefixes...)
+}
+
+// watchLayer is one source of pairs for a mapping: a prefix and the Consul
+// settings to read it with, in order of preference.
+type watchLayer struct {
+	prefix string
+	consul []ConsulConfig
+}
+
+// Resolves the Consul settings for each of a mapping's datacenters, in the
+// order they are listed.
+func mappingCandidates(global ConsulConfig, mappingConfig *MappingConfig) []ConsulConfig {
+	consul := resolveConsulConfig(global, mappingConfig.Consul)
+	consul = resolveConsulConfig(consul, &ConsulConfig{
+		Namespace: mappingConfig.Namespace,
+		Partition: mappingConfig.Partition,
+	})
+
+	if len(mappingConfig.DCs) == 0 {
+		return []ConsulConfig{consul}
+	}
+
+	candidates := make([]ConsulConfig, len(mappingConfig.DCs))
+	for i, dc := range mappingConfig.DCs {
+		candidates[i] = consul
+		candidates[i].DC = dc
+	}
+	return candidates
+}
+
+// Works out where a mapping reads its pairs from, lowest precedence first.  In
+// "merge" mode every datacenter is a layer of its own, later datacenters
+// winning over earlier ones for the same prefix; otherwise each prefix is read
+// from the first datacenter that answers.
+func mappingLayers(global ConsulConfig, mappingConfig *MappingConfig) []watchLayer {
+	candidates := mappingCandidates(global, mappingConfig)
+
+	var layers []watchLayer
+	for _, prefix := range mappingPrefixes(mappingConfig) {
+		if mappingConfig.DCMode == dcModeMerge {
+			for _, candidate := range candidates {
+				layers = append(layers, watchLayer{prefix, []ConsulConfig{candidate}})
+			}
+		} else {
+			layers = append(layers, watchLayer{prefix, candidates})
+		}
+	}
+
+	return layers
+}
+
+// Merges the pairs read for each of a mapping's layers into a single view,
+// keyed by path relative to the prefix they were read from.  Later layers win,
+// and a key holding the deletion marker removes whatever the layers beneath it
+// set.
+func mergeLayers(mappingConfig *MappingConfig, layers []watchLayer, layerPairs []consulapi.KVPairs) map[string]string {
+	merged := make(map[string]string)
+	for i, pairs := range layerPairs {
+		for _, pair := range pairs {
+			log.WithFields(log.Fields{
+				"key": pair.Key,
+			}).Debug("Key present in source")
+			k := strings.TrimPrefix(pair.Key, layers[i].prefix)
+			k = strings.TrimLeft(k, "/")
+
+			if string(pair.Value) == mappingConfig.DeleteMarker {
+				delete(merged, k)
+				continue
+			}
+			merged[k] = string(pair.Value)
+		}
+	}
+
+	return merged
+}
+
+// Reports whether a mapping renders a single file at its path, rather than a
+// directory of keys.
+func rendersSingleFile(mappingConfig *MappingConfig) bool {
+	return mappingConfig.Service != "" || mappingConfig.Template != "" || mappingConfig.Format != ""
+}
+
+// Cleans up a mapping's prefix, path and onchange command so that the rest of
+// the watch code can rely on a consistent format.
+func normalizeMapping(mappingConfig *MappingConfig) {
+	if mappingConfig.OnChangeRaw != "" {
+		mappingConfig.OnChange = strings.Split(mappingConfig.OnChangeRaw, " ")
+	}
+
+	// If prefix starts with /, trim it.
+	mappingConfig.Prefix = strings.TrimPrefix(mappingConfig.Prefix, "/")
+	for i := range mappingConfig.Prefixes {
+		mappingConfig.Prefixes[i] = strings.TrimPrefix(mappingConfig.Prefixes[i], "/")
+	}
+
+	if mappingConfig.DeleteMarker == "" {
+		mappingConfig.DeleteMarker = defaultDeleteMarker
+	}
+
+	// If the config path is lacking a trailing separator, add it.  Mappings
+	// rendering a single file keep their path as given.
+	if !rendersSingleFile(mappingConfig) && mappingConfig.Path[len(mappingConfig.Path)-1] != os.PathSeparator {
+		mappingConfig.Path += string(os.PathSeparator)
+	}
+
+	// Remove an unhandled trailing quote, which presented itself on Windows when
+	// the given path contained spaces (requiring quotes) and also had a trailing
+	// backslash.
+	if mappingConfig.Path[len(mappingConfig.Path)-1] == 34 {
+		mappingConfig.Path = mappingConfig.Path[:len(mappingConfig.Path)-1]
+	}
+}
+
 func buildClient(consulConfig ConsulConfig) (*http.Client, error) {
-	tlsConfig := &tls.Config{}
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	minVersion, err := parseTLSVersion(consulConfig.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := parseCipherSuites(consulConfig.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         consulConfig.TLSServerName,
+		MinVersion:         minVersion,
+		CipherSuites:       cipherSuites,
+		InsecureSkipVerify: consulConfig.TLSSkipVerify,
+	}
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
+	}
 	client := &http.Client{Transport: transport}
 
-	// Check if the user defined a specific CA to use
-	if consulConfig.CAFile != "" {
-		certPool := x509.NewCertPool()
-		if data, err := ioutil.ReadFile(consulConfig.CAFile); err != nil {
-			return nil, err
-		} else if !certPool.AppendCertsFromPEM(data) {
-			return nil, fmt.Errorf("Invalid certificate file: %s", consulConfig.CAFile)
+	if consulConfig.Proxy != "" {
+		proxy, err := url.Parse(consulConfig.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL %s: %v", consulConfig.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	// Agents can also listen on a unix socket, given as unix:///path/to/socket
+	if socket := strings.TrimPrefix(consulConfig.Addr, "unix://"); socket != consulConfig.Addr {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
 		}
-		tlsConfig.RootCAs = certPool
+	}
+
+	// Certificates and CAs are re-read from disk whenever they change, so that
+	// long-running watches survive certificate rotation.
+	reloader, err := newCertReloader(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the user defined a specific CA to use.  crypto/tls can't swap
+	// RootCAs on a live config, so we verify the agent's chain ourselves
+	// against the current pool.
+	if (consulConfig.CAFile != "" || consulConfig.CAPath != "") && !consulConfig.TLSSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = reloader.verifyConnection
 	}
 
 	// Check if TLS was configured for client-side verification
 	if consulConfig.CertFile != "" && consulConfig.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(consulConfig.CertFile, consulConfig.KeyFile)
-		if err != nil {
-			return nil, err
-		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
+		tlsConfig.GetClientCertificate = reloader.clientCertificate
 	}
 	return client, nil
 }
@@ -136,7 +612,15 @@ func buildClient(consulConfig ConsulConfig) (*http.Client, error) {
 func buildConsulClient(consulConfig ConsulConfig) (client *consulapi.Client, err error) {
 	kvConfig := consulapi.DefaultConfig()
 	kvConfig.Address = consulConfig.Addr
+
+	// Our own transport dials unix sockets, so the API client only needs a
+	// placeholder host to build request URLs with.
+	if strings.HasPrefix(consulConfig.Addr, "unix://") {
+		kvConfig.Address = "localhost"
+	}
 	kvConfig.Datacenter = consulConfig.DC
+	kvConfig.Namespace = consulConfig.Namespace
+	kvConfig.Partition = consulConfig.Partition
 
 	// Enforce use of secure connection
 	if consulConfig.UseTLS {
@@ -148,270 +632,546 @@ func buildConsulClient(consulConfig ConsulConfig) (client *consulapi.Client, err
 		return nil, err
 	}
 
+	kvConfig.HttpAuth, err = loadHTTPAuth(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	client, err = consulapi.NewClient(kvConfig)
 	if err != nil {
 		return nil, err
 	}
+
+	if len(consulConfig.Headers) > 0 {
+		headers := make(http.Header)
+		for name, value := range consulConfig.Headers {
+			headers.Set(name, value)
+		}
+		client.SetHeaders(headers)
+	}
 	return client, nil
 }
 
-// Connects to Consul and watches a given K/V prefix and uses that to
-// write to the filesystem.
-func watchMappingAndExec(config *WatchConfig, mappingConfig *MappingConfig) (int, error) {
-	client, err := buildConsulClient(config.Consul)
+// Reads the basic auth credentials, preferring the file so that they need not
+// appear in the config.
+func loadHTTPAuth(consulConfig ConsulConfig) (*consulapi.HttpBasicAuth, error) {
+	credentials := consulConfig.HTTPAuth
+	if consulConfig.HTTPAuthFile != "" {
+		data, err := ioutil.ReadFile(consulConfig.HTTPAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials = strings.TrimSpace(string(data))
+	}
+
+	if credentials == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(credentials, ":", 2)
+	auth := &consulapi.HttpBasicAuth{Username: parts[0]}
+	if len(parts) == 2 {
+		auth.Password = parts[1]
+	}
+	return auth, nil
+}
+
+// Namespaces and admin partitions only exist on Consul Enterprise, and other
+// agents would silently read from the default ones instead.  When either is
+// configured, make sure the agent is an Enterprise one before watching.
+func checkEnterpriseSupport(client *consulapi.Client, consulConfig ConsulConfig) error {
+	if consulConfig.Namespace == "" && consulConfig.Partition == "" {
+		return nil
+	}
+
+	self, err := agentSelf(client, newTokenSource(consulConfig).Token())
+	if isPermissionDenied(err) {
+		// The token may not be allowed to read the agent, so don't refuse to run
+		// just because we could not check.
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Unable to check Consul agent for namespace and partition support")
+		return nil
+	}
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("Unable to check Consul agent at %s for namespace and partition support: %v", consulConfig.Addr, err)
 	}
 
-	// If prefix starts with /, trim it.
-	if mappingConfig.Prefix[0] == '/' {
-		mappingConfig.Prefix = mappingConfig.Prefix[1:]
+	version, _ := self["Config"]["Version"].(string)
+	if !strings.Contains(version, "+ent") {
+		return fmt.Errorf("Consul agent at %s (version %q) does not support namespaces or admin partitions", consulConfig.Addr, version)
 	}
 
-	// If the config path is lacking a trailing separator, add it.
-	if mappingConfig.Path[len(mappingConfig.Path)-1] != os.PathSeparator {
-		mappingConfig.Path += string(os.PathSeparator)
+	return nil
+}
+
+// Reads the agent's own configuration with the given ACL token, which the
+// client doesn't otherwise send outside of queries.
+func agentSelf(client *consulapi.Client, token string) (map[string]map[string]interface{}, error) {
+	var self map[string]map[string]interface{}
+	if _, err := client.Raw().Query("/v1/agent/self", &self, &consulapi.QueryOptions{Token: token}); err != nil {
+		return nil, err
 	}
+	return self, nil
+}
 
-	isWindows := os.PathSeparator != '/'
+// clientCache shares clients between watches with identical Consul settings.
+type clientCache struct {
+	configs []ConsulConfig
+	clients []*consulapi.Client
+}
 
-	// Remove an unhandled trailing quote, which presented itself on Windows when
-	// the given path contained spaces (requiring quotes) and also had a trailing
-	// backslash.
-	if mappingConfig.Path[len(mappingConfig.Path)-1] == 34 {
-		mappingConfig.Path = mappingConfig.Path[:len(mappingConfig.Path)-1]
+func (cache *clientCache) get(consulConfig ConsulConfig) *consulapi.Client {
+	for i := range cache.configs {
+		if reflect.DeepEqual(cache.configs[i], consulConfig) {
+			return cache.clients[i]
+		}
 	}
+	return nil
+}
 
-	// Start the watcher goroutine that watches for changes in the
-	// K/V and notifies us on a channel.
-	errCh := make(chan error, 1)
-	pairCh := make(chan consulapi.KVPairs)
-	quitCh := make(chan struct{})
+// Returns a client for each of the given Consul settings, reusing the ones
+// already built for earlier watches.
+func buildConsulClients(cache *clientCache, consulConfigs []ConsulConfig) ([]*consulapi.Client, error) {
+	clients := make([]*consulapi.Client, len(consulConfigs))
+	for i, consulConfig := range consulConfigs {
+		client := cache.get(consulConfig)
+		if client == nil {
+			var err error
+			client, err = buildConsulClient(consulConfig)
+			if err != nil {
+				return nil, err
+			}
+			if err = checkEnterpriseSupport(client, consulConfig); err != nil {
+				return nil, err
+			}
+			cache.configs = append(cache.configs, consulConfig)
+			cache.clients = append(cache.clients, client)
+		}
+		clients[i] = client
+	}
+	return clients, nil
+}
+
+// Receives the K/V pairs for a mapping's prefix and uses them to write
+// to the filesystem.
+func watchMappingAndExec(config *WatchConfig, feed *mappingFeed) (int, error) {
+	mappingConfig := feed.mapping
 
-	// Defer close of quitCh if we're running more than once
-	if !config.RunOnce {
-		defer close(quitCh)
+	switch mappingConfig.OnError {
+	case "", onErrorSkip, onErrorFail, onErrorPlaceholder:
+	default:
+		return 1, fmt.Errorf("Unknown error policy: %s", mappingConfig.OnError)
 	}
 
-	go watch(
-		client, mappingConfig.Prefix, mappingConfig.Path, config.Consul.Token, pairCh, errCh, quitCh)
+	switch mappingConfig.DCMode {
+	case "", dcModeFailover, dcModeMerge:
+	default:
+		return 1, fmt.Errorf("Unknown DC mode: %s", mappingConfig.DCMode)
+	}
 
-	var env map[string]string
-	for {
-		var pairs consulapi.KVPairs
+	switch mappingConfig.Decryption {
+	case "", decryptionGosecret, decryptionAge, decryptionOpenPGP, decryptionEnvelope:
+	default:
+		return 1, fmt.Errorf("Unknown decryption: %s", mappingConfig.Decryption)
+	}
+	if mappingConfig.KMS != nil {
+		if err := validateKMSConfig(mappingConfig.KMS); err != nil {
+			return 1, err
+		}
+	}
+
+	renderer, err := newFileRenderer(mappingConfig, feed.external)
+	if err != nil {
+		return 1, err
+	}
+	if renderer == nil {
+		// Create the root for KVs, if necessary
+		mkdirp.Mk(mappingConfig.Path, 0777)
+	}
 
-		// Wait for new pairs to come on our channel or an error
-		// to occur.
+	// Templates hear about changes to keys outside the mapping's prefixes too.
+	var externalCh <-chan struct{}
+	if feed.external != nil {
+		externalCh = feed.external.changedCh
+	}
+
+	// The keys as they came from Consul, and the files they were written as.
+	var env, written map[string]string
+	for {
+		// Wait for every layer to have pairs on our feed, for a key our
+		// templates referenced to change, or for an error to occur.
+		externalChanged := false
 		select {
-		case pairs = <-pairCh:
-		case err := <-errCh:
-			return 0, err
+		case <-feed.readyCh:
+		case <-externalCh:
+			externalChanged = true
+		case err := <-feed.errCh:
+			return 1, err
 		}
 
-		newEnv := make(map[string]string)
-		for _, pair := range pairs {
-			log.WithFields(log.Fields{
-				"key": pair.Key,
-			}).Debug("Key present in source")
-			k := strings.TrimPrefix(pair.Key, mappingConfig.Prefix)
-			k = strings.TrimLeft(k, "/")
-			newEnv[k] = string(pair.Value)
-		}
+		newEnv := mergeLayers(mappingConfig, feed.layers, feed.snapshot())
 
 		// If the variables didn't actually change,
 		// then don't do anything.
-		if reflect.DeepEqual(env, newEnv) {
+		if reflect.DeepEqual(env, newEnv) && !externalChanged {
 			continue
 		}
 
-		// Iterate over all objects in the current env.  If they are not in the newEnv, they
-		// were deleted from Consul and should be deleted from disk.
-		for k := range env {
-			if _, ok := newEnv[k]; !ok {
+		// Mappings with a template or format render all their keys into a
+		// single file, and only when that file would change.
+		// Set when some or all of the mapping failed to render, which fails a
+		// -once run after everything else has been done.
+		var renderErr error
+		if renderer != nil {
+			changed, err := renderer.render(newEnv)
+			env = newEnv
+			if err != nil {
 				log.WithFields(log.Fields{
-					"key": k,
-				}).Debug("Key no longer present locally")
-				// Write file to disk
-				keyfile := fmt.Sprintf("%s%s", mappingConfig.Path, k)
-				if isWindows {
-					keyfile = strings.Replace(keyfile, "/", "\\", -1)
-				}
+					"error": err,
+					"file":  mappingConfig.Path,
+				}).Error("Failed to render file")
 
-				err := os.Remove(keyfile)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Failed to remove key")
+				if mappingConfig.OnError != onErrorPlaceholder {
+					if config.RunOnce {
+						return 1, err
+					}
+					continue
 				}
-			}
-		}
-
-		// Replace the env so we can detect future changes
-		env = newEnv
 
-		// Write the updated keys to the filesystem at the specified path
-		for k, v := range newEnv {
-			// Write file to disk
-			keyfile := fmt.Sprintf("%s%s", mappingConfig.Path, k)
-
-			// if Windows, replace / with windows path delimiter
-			if isWindows {
-				keyfile = strings.Replace(keyfile, "/", "\\", -1)
-				// mkdirp the file's path
-				err := mkdirp.Mk(keyfile[:strings.LastIndex(keyfile, "\\")], 0777)
-				if err != nil {
+				if err := writeFileAtomic(mappingConfig.Path, []byte(mappingConfig.ErrorPlaceholder)); err != nil {
 					log.WithFields(log.Fields{
 						"error": err,
-					}).Error("Failed to create parent directory for key")
-				}
-			} else {
-				// mkdirp the file's path
-				err := mkdirp.Mk(keyfile[:strings.LastIndex(keyfile, "/")], 0777)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Failed to create parent directory for key")
+						"file":  mappingConfig.Path,
+					}).Error("Failed to write placeholder")
 				}
+				renderer.forget()
+				renderErr = err
+			} else if !changed {
+				continue
 			}
-
-			f, err := os.Create(keyfile)
+		} else {
+			files, err := explodeValues(mappingConfig, newEnv)
+			env = newEnv
 			if err != nil {
 				log.WithFields(log.Fields{
 					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to create file")
+				}).Error("Failed to parse values")
+				if config.RunOnce {
+					return 1, err
+				}
 				continue
 			}
 
-			defer f.Close()
-
-			log.WithFields(log.Fields{
-				"length": len(v),
-			}).Debug("Input value length")
+			var data *keyTemplateData
+			if mappingConfig.KeyTemplates {
+				data = newKeyTemplateData(mappingConfig, files, feed.node(), feed.external)
+			}
 
-			buff := new(bytes.Buffer)
-			buff.Write([]byte(v))
+			if failed := syncKeys(mappingConfig, data, written, files); len(failed) > 0 {
+				renderErr = fmt.Errorf("Failed to render keys: %s", strings.Join(failed, ", "))
 
-			if len(mappingConfig.Keystore) > 0 {
-				decryptedValue, err := gosecret.DecryptTags([]byte(v), mappingConfig.Keystore)
-				if err != nil {
+				// Under the fail policy nothing was written, so keep the
+				// previous files and don't announce a change.
+				if mappingConfig.OnError == onErrorFail {
 					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Failed to decrypt value")
+						"keys": failed,
+					}).Error("Keeping previous files since keys failed to render")
+					if config.RunOnce {
+						return 1, renderErr
+					}
 					continue
 				}
+			}
 
-				log.WithFields(log.Fields{
-					"length": len(decryptedValue),
-				}).Debug("Output value length")
+			// Replace the files so we can detect future changes
+			written = files
+		}
 
-				data := string(decryptedValue)
+		// Configuration changed, run our onchange command, if one was specified.
+		if err := runOnChange(mappingConfig); err != nil {
+			return 111, err
+		}
 
-				funcs := template.FuncMap{
-					// Template functions
-					"goDecrypt": goDecryptFunc(mappingConfig.Keystore),
-				}
+		// If we are only running once, stop watching for this mapping.
+		if config.RunOnce {
+			if renderErr != nil {
+				return 1, renderErr
+			}
+			return 0, nil
+		}
+	}
+}
 
-				tmpl, err := template.New("decryption").Funcs(funcs).Parse(data)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Could not parse template")
-					continue
-				}
+// fileRenderer writes all of a mapping's keys into the single file at its path,
+// reporting whether the file changed.
+type fileRenderer interface {
+	render(env map[string]string) (bool, error)
 
-				// Run the template to verify the output.
-				buff = new(bytes.Buffer)
-				err = tmpl.Execute(buff, nil)
-				if err != nil {
-					log.WithFields(log.Fields{
-						"error": err,
-					}).Error("Could not execute template")
-					continue
-				}
+	// Forgets what was last written, so the next render writes the file
+	// whatever it held before.
+	forget()
+}
+
+// Reports whether a mapping runs templates that can read keys by name.
+func usesTemplates(mappingConfig *MappingConfig) bool {
+	return mappingConfig.Template != "" || mappingConfig.KeyTemplates
+}
+
+// Returns the renderer for a mapping with a template or a format, or nil for
+// one that writes a file per key.
+func newFileRenderer(mappingConfig *MappingConfig, external *externalKeys) (fileRenderer, error) {
+	switch {
+	case mappingConfig.Template != "":
+		return newTemplateFile(mappingConfig, external)
+	case mappingConfig.Format != "":
+		return &formatFile{mapping: mappingConfig}, nil
+	}
+	return nil, nil
+}
+
+// Brings the files under a mapping's path in line with the new keys, removing
+// those for keys that are gone and writing the rest.  data is what keys that
+// are templates are rendered with.  Returns the keys that failed to render,
+// which are handled according to the mapping's error policy.
+func syncKeys(mappingConfig *MappingConfig, data *keyTemplateData, env map[string]string, newEnv map[string]string) []string {
+	isWindows := os.PathSeparator != '/'
+
+	// Render every key before touching the disk, so that a failure never
+	// leaves a half-written file behind and can leave all of them alone.
+	contents := make(map[string][]byte, len(newEnv))
+	var failed []string
+	for k, v := range newEnv {
+		log.WithFields(log.Fields{
+			"length": len(v),
+		}).Debug("Input value length")
+
+		content, err := keyContent(mappingConfig, data, k, v)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   k,
+			}).Error("Failed to render key")
+			failed = append(failed, k)
+
+			if mappingConfig.OnError == onErrorPlaceholder {
+				contents[k] = []byte(mappingConfig.ErrorPlaceholder)
 			}
+			continue
+		}
+		contents[k] = content
+	}
+	sort.Strings(failed)
+
+	if len(failed) > 0 && mappingConfig.OnError == onErrorFail {
+		return failed
+	}
 
-			wrote, err := f.Write(buff.Bytes())
+	// Iterate over all objects in the current env.  If they are not in the newEnv, they
+	// were deleted from Consul and should be deleted from disk.
+	for k := range env {
+		if _, ok := newEnv[k]; !ok {
+			log.WithFields(log.Fields{
+				"key": k,
+			}).Debug("Key no longer present locally")
+			// Write file to disk
+			keyfile := fmt.Sprintf("%s%s", mappingConfig.Path, keyFileName(mappingConfig, k))
+			if isWindows {
+				keyfile = strings.Replace(keyfile, "/", "\\", -1)
+			}
+
+			err := os.Remove(keyfile)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to write to file")
-				continue
+				}).Error("Failed to remove key")
 			}
+		}
+	}
 
-			log.WithFields(log.Fields{
-				"length": wrote,
-				"file":   keyfile,
-			}).Debug("Successfully wrote value to file")
+	// Write the updated keys to the filesystem at the specified path
+	for k, content := range contents {
+		// Write file to disk
+		keyfile := fmt.Sprintf("%s%s", mappingConfig.Path, keyFileName(mappingConfig, k))
 
-			err = f.Sync()
+		// if Windows, replace / with windows path delimiter
+		if isWindows {
+			keyfile = strings.Replace(keyfile, "/", "\\", -1)
+			// mkdirp the file's path
+			err := mkdirp.Mk(keyfile[:strings.LastIndex(keyfile, "\\")], 0777)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to sync file")
+				}).Error("Failed to create parent directory for key")
 			}
-
-			err = f.Close()
+		} else {
+			// mkdirp the file's path
+			err := mkdirp.Mk(keyfile[:strings.LastIndex(keyfile, "/")], 0777)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"error": err,
-					"file":  keyfile,
-				}).Error("Failed to close file")
+				}).Error("Failed to create parent directory for key")
 			}
 		}
 
-		// Configuration changed, run our onchange command, if one was specified.
-		if mappingConfig.OnChange != nil {
-			var cmd = exec.Command(mappingConfig.OnChange[0], mappingConfig.OnChange[1:]...)
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			// Always wait for the forked process to exit.  We may wish to revisit this, but I think
-			// it's the safest approach since it avoids a case where rapid key updates DOS a system
-			// by slurping all proc handles.
-			err = cmd.Run()
+		f, err := os.Create(keyfile)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"file":  keyfile,
+			}).Error("Failed to create file")
+			continue
+		}
 
-			if err != nil {
-				return 111, err
-			}
+		defer f.Close()
+
+		wrote, err := f.Write(content)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"file":  keyfile,
+			}).Error("Failed to write to file")
+			continue
 		}
 
-		// If we are only running once, close the channel on this watcher.
-		if config.RunOnce {
-			close(quitCh)
-			return 0, nil
+		log.WithFields(log.Fields{
+			"length": wrote,
+			"file":   keyfile,
+		}).Debug("Successfully wrote value to file")
+
+		err = f.Sync()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"file":  keyfile,
+			}).Error("Failed to sync file")
+		}
+
+		err = f.Close()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"file":  keyfile,
+			}).Error("Failed to close file")
 		}
 	}
+
+	return failed
+}
+
+// Works out what a key's file should hold: the rendered template, the
+// decrypted value, or the value as it is.
+func keyContent(mappingConfig *MappingConfig, data *keyTemplateData, k string, v string) ([]byte, error) {
+	if isKeyTemplate(mappingConfig, k) {
+		return renderKeyTemplate(mappingConfig, data, k, v)
+	}
+	if decryptsValues(mappingConfig) {
+		return decryptValue(mappingConfig, v)
+	}
+	return []byte(v), nil
+}
+
+// Decrypts a value with whichever decryptor suits it, or returns it as it is
+// when none does.
+func decryptValue(mappingConfig *MappingConfig, v string) ([]byte, error) {
+	decryptor, err := selectDecryptor(mappingConfig, []byte(v))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load decryption keys")
+		return nil, err
+	}
+	if decryptor == nil {
+		return []byte(v), nil
+	}
+
+	decryptedValue, err := decryptor.decrypt([]byte(v))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to decrypt value")
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"length": len(decryptedValue),
+	}).Debug("Output value length")
+
+	return decryptedValue, nil
+}
+
+// Runs a mapping's onchange command, if one was specified.
+func runOnChange(mappingConfig *MappingConfig) error {
+	if mappingConfig.OnChange == nil {
+		return nil
+	}
+
+	var cmd = exec.Command(mappingConfig.OnChange[0], mappingConfig.OnChange[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Always wait for the forked process to exit.  We may wish to revisit this, but I think
+	// it's the safest approach since it avoids a case where rapid key updates DOS a system
+	// by slurping all proc handles.
+	return cmd.Run()
+}
+
+// How long a blocking query may wait while failed over to a less preferred
+// datacenter before we check whether the preferred one is back.
+const failbackInterval = 30 * time.Second
+
+// consulQuery is a read against Consul that can be made into a blocking query
+// through the WaitIndex of its options.
+type consulQuery func(client *consulapi.Client, opts *consulapi.QueryOptions) (interface{}, *consulapi.QueryMeta, error)
+
+// Lists the K/V pairs under a prefix.
+func kvListQuery(prefix string) consulQuery {
+	return func(client *consulapi.Client, opts *consulapi.QueryOptions) (interface{}, *consulapi.QueryMeta, error) {
+		return client.KV().List(prefix, opts)
+	}
 }
 
+func kvGetQuery(key string) consulQuery {
+	return func(client *consulapi.Client, opts *consulapi.QueryOptions) (interface{}, *consulapi.QueryMeta, error) {
+		return client.KV().Get(key, opts)
+	}
+}
+
+// Watches the result of a query through the first of the given clients that
+// answers.  The clients are in order of preference; when the active one becomes
+// unreachable the watch fails over to the next, and it fails back to the first
+// as soon as that is reachable again.
 func watch(
-	client *consulapi.Client,
-	prefix string,
-	path string,
-	token string,
-	pairCh chan<- consulapi.KVPairs,
+	clients []*consulapi.Client,
+	name string,
+	query consulQuery,
+	tokens *tokenSource,
+	resultCh chan<- interface{},
 	errCh chan<- error,
 	quitCh <-chan struct{}) {
 
-	// Create the root for KVs, if necessary
-	mkdirp.Mk(path, 0777)
-
-	// Get the initial list of k/v pairs. We don't do a retryableList
+	// Get the initial result. We don't do a retryableList
 	// here because we want a fast fail if the initial request fails.
-	opts := &consulapi.QueryOptions{Token: token}
-	pairs, meta, err := client.KV().List(prefix, opts)
+	active := 0
+	result, meta, err := runQuery(clients[active], name, query, tokens, consulapi.QueryOptions{})
+	for err != nil && active+1 < len(clients) {
+		active++
+		result, meta, err = runQuery(clients[active], name, query, tokens, consulapi.QueryOptions{})
+	}
 	if err != nil {
 		errCh <- err
 		return
 	}
 
-	// Send the initial list out right away
-	pairCh <- pairs
+	// Send the initial result out right away
+	select {
+	case resultCh <- result:
+	case <-quitCh:
+		return
+	}
 
-	// Loop forever (or until quitCh is closed) and watch the keys
+	// Loop forever (or until quitCh is closed) and watch the result
 	// for changes.
-	curIndex := meta.LastIndex
+	curIndex := nextWaitIndex(0, meta.LastIndex)
 	for {
 		select {
 		case <-quitCh:
@@ -419,32 +1179,113 @@ func watch(
 		default:
 		}
 
-		pairs, meta, err = retryableList(
-			func() (consulapi.KVPairs, *consulapi.QueryMeta, error) {
-				opts = &consulapi.QueryOptions{WaitIndex: curIndex, Token: token}
-				return client.KV().List(prefix, opts)
+		var waitTime time.Duration
+		if active > 0 {
+			result, meta, err = runQuery(clients[0], name, query, tokens, consulapi.QueryOptions{})
+			if err == nil {
+				log.WithFields(log.Fields{
+					"watch": name,
+				}).Info("Preferred datacenter is reachable again, failing back")
+
+				active = 0
+				select {
+				case resultCh <- result:
+				case <-quitCh:
+					return
+				}
+				curIndex = nextWaitIndex(0, meta.LastIndex)
+				continue
+			}
+
+			waitTime = failbackInterval
+		}
+
+		result, meta, err = retryableList(
+			func() (interface{}, *consulapi.QueryMeta, error) {
+				opts := consulapi.QueryOptions{WaitIndex: curIndex, WaitTime: waitTime}
+				return runQuery(clients[active], name, query, tokens, opts)
 			})
 
 		if err != nil {
 			// This happens when the connection to the consul agent dies.  Build in a retry by looping after a delay.
 			log.Warn("Error communicating with consul agent.")
+
+			// Indexes are not comparable between datacenters, so start the
+			// next one off with a fresh read.
+			if len(clients) > 1 {
+				active = (active + 1) % len(clients)
+				curIndex = 0
+				log.WithFields(log.Fields{
+					"watch": name,
+					"error": err,
+				}).Warn("Failing over to next datacenter")
+			}
 			continue
 		}
 
-		pairCh <- pairs
+		select {
+		case resultCh <- result:
+		case <-quitCh:
+			return
+		}
 		log.WithFields(log.Fields{
 			"curIndex":  curIndex,
 			"lastIndex": meta.LastIndex,
 		}).Debug("Potential index update observed")
-		curIndex = meta.LastIndex
+		curIndex = nextWaitIndex(curIndex, meta.LastIndex)
+	}
+}
+
+// Runs a query with the current token.  If Consul rejects the token, the token
+// file may have been rotated under us, so read it again and retry once before
+// giving up.
+func runQuery(client *consulapi.Client, name string, query consulQuery, tokens *tokenSource, opts consulapi.QueryOptions) (interface{}, *consulapi.QueryMeta, error) {
+	token := tokens.Token()
+	opts.Token = token
+	result, meta, err := query(client, &opts)
+	if !isPermissionDenied(err) {
+		return result, meta, err
+	}
+
+	tokens.invalidate()
+	if opts.Token = tokens.Token(); opts.Token == token {
+		return result, meta, err
+	}
+
+	log.WithFields(log.Fields{
+		"watch": name,
+	}).Info("ACL token was rejected, retrying with the token re-read from file")
+	return query(client, &opts)
+}
+
+// Works out the index to use for the next blocking query, following Consul's
+// blocking query guidance.  If the index went backwards (e.g. the cluster was
+// restored from a snapshot) or the agent returned zero, we reset so the next
+// query is a fresh non-blocking read rather than a wait on an index that may
+// never be reached.
+func nextWaitIndex(curIndex, lastIndex uint64) uint64 {
+	if lastIndex < curIndex || lastIndex == 0 {
+		log.WithFields(log.Fields{
+			"curIndex":  curIndex,
+			"lastIndex": lastIndex,
+		}).Warn("Consul index went backwards or was reset, resetting watch")
+
+		// A fresh read that still reports zero must not be repeated in a tight
+		// loop, so fall back to blocking on the lowest valid index.
+		if curIndex == 0 {
+			return 1
+		}
+		return 0
 	}
+
+	return lastIndex
 }
 
-// This function is able to call KV listing functions and retry them.
-// We want to retry if there are errors because it is safe (GET request),
-// and erroring early is MUCH more costly than retrying over time and
+// This function is able to call K/V listing and other query functions and
+// retry them.  We want to retry if there are errors because it is safe (GET
+// request), and erroring early is MUCH more costly than retrying over time and
 // delaying the configuration propagation.
-func retryableList(f func() (consulapi.KVPairs, *consulapi.QueryMeta, error)) (consulapi.KVPairs, *consulapi.QueryMeta, error) {
+func retryableList(f func() (interface{}, *consulapi.QueryMeta, error)) (interface{}, *consulapi.QueryMeta, error) {
 	i := 0
 	for {
 		p, m, e := f()
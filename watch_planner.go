@@ -0,0 +1,217 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// watchGroup is a single blocking query against Consul that serves every
+// mapping layer whose prefix falls under the group's prefix.
+type watchGroup struct {
+	consul        []ConsulConfig
+	prefix        string
+	subscriptions []*subscription
+}
+
+// subscription ties one layer of a mapping to the watch that serves it.
+type subscription struct {
+	feed   *mappingFeed
+	layer  int
+	prefix string
+}
+
+// mappingFeed collects the latest pairs for each layer of a mapping and tells
+// the mapping when there is something new to write.
+type mappingFeed struct {
+	mapping *MappingConfig
+	layers  []watchLayer
+	readyCh chan struct{}
+	errCh   chan error
+	doneCh  chan struct{}
+
+	// Looks up the keys outside the mapping's prefixes that its templates
+	// refer to.  It is only set for mappings with templates.
+	external *externalKeys
+
+	lock  sync.Mutex
+	pairs []consulapi.KVPairs
+	seen  []bool
+	agent *nodeInfo
+}
+
+func newMappingFeed(mappingConfig *MappingConfig, layers []watchLayer) *mappingFeed {
+	return &mappingFeed{
+		mapping: mappingConfig,
+		layers:  layers,
+		readyCh: make(chan struct{}, 1),
+		errCh:   make(chan error, 1),
+		doneCh:  make(chan struct{}),
+		pairs:   make([]consulapi.KVPairs, len(layers)),
+		seen:    make([]bool, len(layers)),
+	}
+}
+
+// Records the latest pairs for one layer.  The mapping is only woken once every
+// layer has been heard from, so it never writes a partially merged view.
+func (feed *mappingFeed) update(layer int, pairs consulapi.KVPairs) {
+	feed.lock.Lock()
+	feed.pairs[layer] = pairs
+	feed.seen[layer] = true
+	ready := true
+	for _, seen := range feed.seen {
+		ready = ready && seen
+	}
+	feed.lock.Unlock()
+
+	if !ready {
+		return
+	}
+
+	// Only the latest view matters, so a wakeup that is already pending covers
+	// this update too.
+	select {
+	case feed.readyCh <- struct{}{}:
+	default:
+	}
+}
+
+// Returns a copy of the latest pairs for every layer.
+func (feed *mappingFeed) snapshot() []consulapi.KVPairs {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+
+	pairs := make([]consulapi.KVPairs, len(feed.pairs))
+	copy(pairs, feed.pairs)
+	return pairs
+}
+
+// Returns the node the mapping reads from, if it has been looked up.
+func (feed *mappingFeed) node() *nodeInfo {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	return feed.agent
+}
+
+func (feed *mappingFeed) setNode(node *nodeInfo) {
+	feed.lock.Lock()
+	feed.agent = node
+	feed.lock.Unlock()
+}
+
+// Hands an error to the mapping.  The first error is enough to stop it, so
+// later ones are dropped.
+func (feed *mappingFeed) fail(err error) {
+	select {
+	case feed.errCh <- err:
+	default:
+	}
+}
+
+func (feed *mappingFeed) done() bool {
+	select {
+	case <-feed.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Collapses identical or overlapping prefixes into as few watches as possible.
+// Consul lists keys by plain string prefix, so a watch on "app/" already sees
+// everything a watch on "app/db/" would, as long as both resolve to the same
+// Consul settings.
+func planWatches(feeds []*mappingFeed) []*watchGroup {
+	type layer struct {
+		subscription
+		consul []ConsulConfig
+	}
+
+	var layers []layer
+	for _, feed := range feeds {
+		for i, l := range feed.layers {
+			layers = append(layers, layer{subscription{feed, i, l.prefix}, l.consul})
+		}
+	}
+
+	// Visit the shortest prefixes first so that they become the groups the
+	// longer ones are folded into.
+	sort.SliceStable(layers, func(i, j int) bool {
+		return len(layers[i].prefix) < len(layers[j].prefix)
+	})
+
+	var groups []*watchGroup
+	for i := range layers {
+		l := &layers[i]
+
+		var group *watchGroup
+		for _, candidate := range groups {
+			if reflect.DeepEqual(candidate.consul, l.consul) && strings.HasPrefix(l.prefix, candidate.prefix) {
+				group = candidate
+				break
+			}
+		}
+
+		if group == nil {
+			group = &watchGroup{
+				consul: l.consul,
+				prefix: l.prefix,
+			}
+			groups = append(groups, group)
+		}
+
+		group.subscriptions = append(group.subscriptions, &l.subscription)
+	}
+
+	return groups
+}
+
+// Runs the blocking query for a group and fans each response out to the
+// layers it serves, filtered down to each layer's own prefix.
+func runWatchGroup(clients []*consulapi.Client, group *watchGroup) {
+	resultCh := make(chan interface{})
+	errCh := make(chan error, 1)
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+
+	go watch(clients, group.prefix, kvListQuery(group.prefix), newTokenSource(group.consul[0]), resultCh, errCh, quitCh)
+
+	for {
+		select {
+		case result := <-resultCh:
+			pairs := result.(consulapi.KVPairs)
+			live := 0
+			for _, sub := range group.subscriptions {
+				if sub.feed.done() {
+					continue
+				}
+				live++
+				sub.feed.update(sub.layer, filterPairs(pairs, sub.prefix))
+			}
+
+			// Every mapping has stopped, so there is nobody left to watch for.
+			if live == 0 {
+				return
+			}
+		case err := <-errCh:
+			for _, sub := range group.subscriptions {
+				sub.feed.fail(err)
+			}
+			return
+		}
+	}
+}
+
+// Returns the pairs whose keys fall under the given prefix.
+func filterPairs(pairs consulapi.KVPairs, prefix string) consulapi.KVPairs {
+	filtered := make(consulapi.KVPairs, 0, len(pairs))
+	for _, pair := range pairs {
+		if strings.HasPrefix(pair.Key, prefix) {
+			filtered = append(filtered, pair)
+		}
+	}
+	return filtered
+}
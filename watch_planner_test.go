@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Builds the feeds watchAndExec would hand to the planner.
+func planTestWatches(config *WatchConfig) []*watchGroup {
+	feeds := make([]*mappingFeed, len(config.Mappings))
+	for i := range config.Mappings {
+		normalizeMapping(&config.Mappings[i])
+		feeds[i] = newMappingFeed(&config.Mappings[i], mappingLayers(config.Consul, &config.Mappings[i]))
+	}
+	return planWatches(feeds)
+}
+
+// Flattens a plan into the group prefix followed by the path and layer
+// prefix of each mapping it serves.
+func describePlan(groups []*watchGroup) [][]string {
+	var plan [][]string
+	for _, group := range groups {
+		described := []string{group.prefix}
+		for _, sub := range group.subscriptions {
+			described = append(described, sub.feed.mapping.Path+"@"+sub.prefix)
+		}
+		plan = append(plan, described)
+	}
+	return plan
+}
+
+func TestPlanWatches(t *testing.T) {
+	config := WatchConfig{
+		Consul: httpConsulConfig,
+		Mappings: []MappingConfig{
+			{Prefix: "app/db/", Path: "/etc/db/"},
+			{Prefix: "other/", Path: "/etc/other/"},
+			{Prefix: "app/", Path: "/etc/app/"},
+			{Prefix: "app/", Path: "/etc/app-copy/"},
+		},
+	}
+
+	expected := [][]string{
+		{"app/", "/etc/app/@app/", "/etc/app-copy/@app/", "/etc/db/@app/db/"},
+		{"other/", "/etc/other/@other/"},
+	}
+	if plan := describePlan(planTestWatches(&config)); !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("Unexpected watch plan %v, expected %v", plan, expected)
+	}
+}
+
+// Mappings that overlap but talk to Consul differently must not share a watch.
+func TestPlanWatchesPerMappingConsul(t *testing.T) {
+	config := WatchConfig{
+		Consul: httpConsulConfig,
+		Mappings: []MappingConfig{
+			{Prefix: "app/", Path: "/etc/app/"},
+			{Prefix: "app/db/", Path: "/etc/db/", Consul: &ConsulConfig{Token: "db-reader"}},
+			{Prefix: "app/web/", Path: "/etc/web/", Consul: &ConsulConfig{DC: "dc1"}},
+		},
+	}
+
+	groups := planTestWatches(&config)
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 watches, got %d", len(groups))
+	}
+
+	if groups[1].prefix != "app/db/" || groups[1].consul[0].Token != "db-reader" || groups[1].consul[0].Addr != httpConsulConfig.Addr {
+		t.Fatalf("Unexpected watch for overridden mapping: %+v", groups[1])
+	}
+}
+
+func TestPlanWatchesLayers(t *testing.T) {
+	config := WatchConfig{
+		Consul: httpConsulConfig,
+		Mappings: []MappingConfig{
+			{Prefix: "global/", Prefixes: []string{"env/prod/", "app/x/prod/"}, Path: "/etc/x/"},
+			{Prefix: "/env/", Path: "/etc/env/"},
+		},
+	}
+
+	expected := [][]string{
+		{"env/", "/etc/env/@env/", "/etc/x/@env/prod/"},
+		{"global/", "/etc/x/@global/"},
+		{"app/x/prod/", "/etc/x/@app/x/prod/"},
+	}
+	if plan := describePlan(planTestWatches(&config)); !reflect.DeepEqual(plan, expected) {
+		t.Fatalf("Unexpected watch plan %v, expected %v", plan, expected)
+	}
+}
+
+func TestFilterPairs(t *testing.T) {
+	pairs := consulapi.KVPairs{
+		{Key: "app/name"},
+		{Key: "app/db/host"},
+		{Key: "application"},
+	}
+
+	filtered := filterPairs(pairs, "app/db/")
+	if len(filtered) != 1 || filtered[0].Key != "app/db/host" {
+		t.Fatalf("Unexpected filtered pairs %v", filtered)
+	}
+}
+
+// Run two overlapping mappings against a fake agent and check that they share
+// a single query while each still gets its own keys.
+func TestSharedWatch(t *testing.T) {
+	var lock sync.Mutex
+	requested := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requested[r.URL.Path] = true
+		lock.Unlock()
+		w.Header().Set("X-Consul-Index", "1")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"Key":"app/name","Value":"YXBw"},{"Key":"app/db/host","Value":"ZGI="}]`)
+	}))
+	defer server.Close()
+
+	appDir := createTempDir(t)
+	dbDir := createTempDir(t)
+	defer os.RemoveAll(appDir)
+	defer os.RemoveAll(dbDir)
+
+	config := WatchConfig{
+		RunOnce: true,
+		Consul:  ConsulConfig{Addr: server.Listener.Addr().String()},
+		Mappings: []MappingConfig{
+			{Prefix: "app/", Path: appDir},
+			{Prefix: "app/db", Path: dbDir},
+		},
+	}
+
+	if rvalue := watchAndExec(&config); rvalue != 0 {
+		t.Fatalf("watchAndExec returned %d", rvalue)
+	}
+
+	lock.Lock()
+	if len(requested) != 1 || !requested["/v1/kv/app/"] {
+		t.Fatalf("Expected a single watch on app/, got %v", requested)
+	}
+	lock.Unlock()
+
+	for file, expected := range map[string]string{
+		path.Join(appDir, "name"):    "app",
+		path.Join(appDir, "db/host"): "db",
+		path.Join(dbDir, "host"):     "db",
+	} {
+		actual, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(actual) != expected {
+			t.Fatalf("Unexpected value %q in %s", actual, file)
+		}
+	}
+}
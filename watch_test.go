@@ -7,9 +7,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -459,4 +465,491 @@ func TestFileDecryption(t *testing.T) {
 	if !bytes.Equal(actualFileWritten, expectedDecyptedFile) {
 		t.Fatal("Unmatched values - Decryption may have failed.")
 	}
-}
\ No newline at end of file
+}
+
+// Serve a prefix whose index rewinds, as it would after a snapshot restore,
+// and check that the watch falls back to a non-blocking read instead of
+// waiting on the stale index.
+func TestIndexReset(t *testing.T) {
+	indexes := []string{"10", "20", "5", "6"}
+	requested := make(chan string, len(indexes))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- r.URL.Query().Get("index")
+		w.Header().Set("X-Consul-Index", indexes[0])
+		if len(indexes) > 1 {
+			indexes = indexes[1:]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"Key":"reset/entry","Value":"dmFsdWU="}]`)
+	}))
+	defer server.Close()
+
+	client, err := buildConsulClient(ConsulConfig{Addr: server.Listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	resultCh := make(chan interface{}, len(indexes))
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+
+	go watch([]*consulapi.Client{client}, "reset", kvListQuery("reset"), &tokenSource{}, resultCh, errCh, quitCh)
+
+	expected := []string{"", "10", "20", ""}
+	for i, index := range expected {
+		select {
+		case <-resultCh:
+		case err := <-errCh:
+			t.Fatalf("err: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for response %d", i)
+		}
+
+		if actual := <-requested; actual != index {
+			t.Fatalf("Request %d used index %q, expected %q", i, actual, index)
+		}
+	}
+}
+
+func TestNextWaitIndex(t *testing.T) {
+	for _, test := range []struct {
+		cur, last, expected uint64
+	}{
+		{10, 20, 20},
+		{20, 20, 20},
+		{20, 5, 0},
+		{20, 0, 0},
+		{0, 0, 1},
+		{0, 7, 7},
+	} {
+		if actual := nextWaitIndex(test.cur, test.last); actual != test.expected {
+			t.Errorf("nextWaitIndex(%d, %d) = %d, expected %d", test.cur, test.last, actual, test.expected)
+		}
+	}
+}
+
+func TestResolveConsulConfig(t *testing.T) {
+	global := ConsulConfig{Addr: "localhost:8500", DC: "dc1", Token: "global"}
+
+	if resolved := resolveConsulConfig(global, nil); !reflect.DeepEqual(resolved, global) {
+		t.Fatalf("Expected global config without an override, got %+v", resolved)
+	}
+
+	resolved := resolveConsulConfig(global, &ConsulConfig{DC: "dc2", UseTLS: true})
+	expected := ConsulConfig{Addr: "localhost:8500", DC: "dc2", Token: "global", UseTLS: true}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Fatalf("Resolved %+v, expected %+v", resolved, expected)
+	}
+}
+
+func TestMergeLayers(t *testing.T) {
+	mappingConfig := MappingConfig{
+		Prefix:   "global/",
+		Prefixes: []string{"env/prod/", "app/x/prod/"},
+		Path:     "/etc/x/",
+	}
+	normalizeMapping(&mappingConfig)
+
+	merged := mergeLayers(&mappingConfig, mappingLayers(httpConsulConfig, &mappingConfig), []consulapi.KVPairs{
+		{
+			{Key: "global/log_level", Value: []byte("info")},
+			{Key: "global/db/host", Value: []byte("db.global")},
+			{Key: "global/feature", Value: []byte("on")},
+		},
+		{
+			{Key: "env/prod/db/host", Value: []byte("db.prod")},
+			{Key: "env/prod/feature", Value: []byte(defaultDeleteMarker)},
+		},
+		{
+			{Key: "app/x/prod/log_level", Value: []byte("debug")},
+		},
+	})
+
+	expected := map[string]string{
+		"log_level": "debug",
+		"db/host":   "db.prod",
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("Merged %v, expected %v", merged, expected)
+	}
+}
+
+func TestMappingLayersDCs(t *testing.T) {
+	mappingConfig := MappingConfig{
+		Prefix:   "global/",
+		Prefixes: []string{"app/"},
+		DCs:      []string{"dc1", "dc2"},
+	}
+
+	layers := mappingLayers(httpConsulConfig, &mappingConfig)
+	if len(layers) != 2 || len(layers[0].consul) != 2 || layers[0].consul[1].DC != "dc2" {
+		t.Fatalf("Expected one failover layer per prefix, got %+v", layers)
+	}
+
+	mappingConfig.DCMode = dcModeMerge
+	layers = mappingLayers(httpConsulConfig, &mappingConfig)
+	var described []string
+	for _, layer := range layers {
+		described = append(described, layer.prefix+"@"+layer.consul[0].DC)
+	}
+	expected := []string{"global/@dc1", "global/@dc2", "app/@dc1", "app/@dc2"}
+	if !reflect.DeepEqual(described, expected) {
+		t.Fatalf("Merge layers %v, expected %v", described, expected)
+	}
+}
+
+// Read from a secondary datacenter while the primary is failing, and go back
+// to the primary once it recovers.
+func TestWatchFailover(t *testing.T) {
+	var primaryUp int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&primaryUp) == 0 {
+			http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[{"Key":"failover/dc","Value":"cHJpbWFyeQ=="}]`)
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[{"Key":"failover/dc","Value":"c2Vjb25kYXJ5"}]`)
+	}))
+	defer secondary.Close()
+
+	var clients []*consulapi.Client
+	for _, server := range []*httptest.Server{primary, secondary} {
+		client, err := buildConsulClient(ConsulConfig{Addr: server.Listener.Addr().String()})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		clients = append(clients, client)
+	}
+
+	errCh := make(chan error, 1)
+	resultCh := make(chan interface{})
+	quitCh := make(chan struct{})
+	defer close(quitCh)
+
+	go watch(clients, "failover", kvListQuery("failover"), &tokenSource{}, resultCh, errCh, quitCh)
+
+	next := func() string {
+		select {
+		case result := <-resultCh:
+			return string(result.(consulapi.KVPairs)[0].Value)
+		case err := <-errCh:
+			t.Fatalf("err: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for pairs")
+		}
+		return ""
+	}
+
+	if value := next(); value != "secondary" {
+		t.Fatalf("Expected initial read from secondary, got %q", value)
+	}
+
+	atomic.StoreInt32(&primaryUp, 1)
+	for value := next(); value != "primary"; value = next() {
+	}
+}
+
+func TestNamespaceAndPartition(t *testing.T) {
+	version := "1.15.2"
+	query := make(chan url.Values, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/agent/self" {
+			fmt.Fprintf(w, `{"Config":{"Version":%q}}`, version)
+			return
+		}
+		query <- r.URL.Query()
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	consulConfig := ConsulConfig{
+		Addr:      server.Listener.Addr().String(),
+		Namespace: "team-a",
+		Partition: "web",
+	}
+
+	if _, err := buildConsulClients(&clientCache{}, []ConsulConfig{consulConfig}); err == nil {
+		t.Fatal("Expected an error from an agent without namespace support")
+	}
+
+	version = "1.15.2+ent"
+	clients, err := buildConsulClients(&clientCache{}, []ConsulConfig{consulConfig})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, _, err := clients[0].KV().List("ns", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	values := <-query
+	if values.Get("ns") != "team-a" || values.Get("partition") != "web" {
+		t.Fatalf("Namespace and partition not passed on query: %v", values)
+	}
+}
+
+// CONSUL_* variables fill in what the config leaves out, but never override it.
+func TestApplyEnvironment(t *testing.T) {
+	for name, value := range map[string]string{
+		"CONSUL_HTTP_ADDR":       "unix:///var/run/consul.sock",
+		"CONSUL_HTTP_SSL":        "true",
+		"CONSUL_HTTP_TOKEN":      "from-env",
+		"CONSUL_CACERT":          "/etc/consul/ca.pem",
+		"CONSUL_TLS_SERVER_NAME": "consul.internal",
+	} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	consulConfig := ConsulConfig{CAFile: "test_data/ca.cert"}
+	applyEnvironment(&consulConfig)
+
+	expected := ConsulConfig{
+		Addr:          "unix:///var/run/consul.sock",
+		Token:         "from-env",
+		CAFile:        "test_data/ca.cert",
+		UseTLS:        true,
+		TLSServerName: "consul.internal",
+	}
+	if !reflect.DeepEqual(consulConfig, expected) {
+		t.Fatalf("Got %+v, expected %+v", consulConfig, expected)
+	}
+}
+
+func TestUnixSocketAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "consul.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[{"Key":"socket/entry","Value":"dmFsdWU="}]`)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	client, err := buildConsulClient(ConsulConfig{Addr: "unix://" + socket})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	pairs, _, err := client.KV().List("socket", nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(pairs) != 1 || string(pairs[0].Value) != "value" {
+		t.Fatalf("Unexpected pairs %v", pairs)
+	}
+}
+
+func TestHTTPAuthHeadersAndProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul_test")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	authFile := path.Join(dir, "auth")
+	if err := ioutil.WriteFile(authFile, []byte("fsconsul:s3cret:with-colon\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The "proxy" answers for Consul itself, which is all we need to know
+	// that requests went through it.
+	proxied := make(chan *http.Request, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r
+		w.Header().Set("X-Consul-Index", "1")
+		fmt.Fprint(w, `[]`)
+	}))
+	defer proxy.Close()
+
+	client, err := buildConsulClient(ConsulConfig{
+		Addr:         "consul.invalid:8500",
+		HTTPAuthFile: authFile,
+		Headers:      map[string]string{"X-Team": "platform"},
+		Proxy:        proxy.URL,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, _, err := client.KV().List("proxied", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r := <-proxied
+	if r.URL.Host != "consul.invalid:8500" {
+		t.Fatalf("Expected a proxied request for consul.invalid:8500, got %v", r.URL)
+	}
+	if username, password, _ := r.BasicAuth(); username != "fsconsul" || password != "s3cret:with-colon" {
+		t.Fatalf("Unexpected basic auth %q:%q", username, password)
+	}
+	if team := r.Header.Get("X-Team"); team != "platform" {
+		t.Fatalf("Unexpected X-Team header %q", team)
+	}
+}
+
+func TestSyncKeysErrorPolicy(t *testing.T) {
+	for _, policy := range []string{onErrorSkip, onErrorFail, onErrorPlaceholder} {
+		dir, err := ioutil.TempDir("", "fsconsul-policy")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		mappingConfig := &MappingConfig{
+			Path:             dir + "/",
+			KeyTemplates:     true,
+			OnError:          policy,
+			ErrorPlaceholder: "unavailable",
+		}
+
+		old := map[string]string{"good": "old", "bad.tmpl": "old"}
+		syncKeys(mappingConfig, newKeyTemplateData(mappingConfig, old, nil, nil), nil, old)
+
+		env := map[string]string{"good": "new", "bad.tmpl": `{{key "missing"}}`, "added": "new"}
+		failed := syncKeys(mappingConfig, newKeyTemplateData(mappingConfig, env, nil, nil), old, env)
+		if !reflect.DeepEqual(failed, []string{"bad.tmpl"}) {
+			t.Fatalf("%s: expected bad.tmpl to fail, got %v", policy, failed)
+		}
+
+		expected := map[string]string{
+			onErrorSkip:        "new old new",
+			onErrorFail:        "old old ",
+			onErrorPlaceholder: "new unavailable new",
+		}[policy]
+
+		good, _ := ioutil.ReadFile(path.Join(dir, "good"))
+		bad, _ := ioutil.ReadFile(path.Join(dir, "bad"))
+		added, _ := ioutil.ReadFile(path.Join(dir, "added"))
+		if got := fmt.Sprintf("%s %s %s", good, bad, added); got != expected {
+			t.Fatalf("%s: expected %q, got %q", policy, expected, got)
+		}
+	}
+}
+
+func TestRunOnceFailsOnRenderError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul-once")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mappingConfig := &MappingConfig{
+		Prefix:       "app/",
+		Path:         dir,
+		KeyTemplates: true,
+	}
+	normalizeMapping(mappingConfig)
+
+	feed := newMappingFeed(mappingConfig, mappingLayers(ConsulConfig{}, mappingConfig))
+	feed.update(0, consulapi.KVPairs{
+		{Key: "app/good", Value: []byte("ok")},
+		{Key: "app/bad.tmpl", Value: []byte(`{{key "missing"}}`)},
+	})
+
+	returnCode, err := watchMappingAndExec(&WatchConfig{RunOnce: true}, feed)
+	if returnCode == 0 || err == nil {
+		t.Fatalf("Expected a failure, got %d %v", returnCode, err)
+	}
+
+	// The keys that rendered are still written.
+	if data, err := ioutil.ReadFile(path.Join(dir, "good")); err != nil || string(data) != "ok" {
+		t.Fatalf("Expected good to be written, got %q %v", data, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "bad")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file for the failed key, got %v", err)
+	}
+}
+
+func TestRunOnceFailsOnBrokenMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsconsul-once")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	templatePath := path.Join(dir, "app.tmpl")
+	ioutil.WriteFile(templatePath, []byte("{{key"), 0644)
+
+	for name, mappingConfig := range map[string]*MappingConfig{
+		"error policy": {Prefix: "app/", Path: dir, OnError: "ignore"},
+		"decryption":   {Prefix: "app/", Path: dir, Decryption: "rot13"},
+		"dc mode":      {Prefix: "app/", Path: dir, DCs: []string{"dc1", "dc2"}, DCMode: "merged"},
+		"kms":          {Prefix: "app/", Path: dir, KMS: &KMSConfig{}},
+		"template":     {Prefix: "app/", Path: path.Join(dir, "app.conf"), Template: templatePath},
+	} {
+		normalizeMapping(mappingConfig)
+		feed := newMappingFeed(mappingConfig, mappingLayers(ConsulConfig{}, mappingConfig))
+
+		returnCode, err := watchMappingAndExec(&WatchConfig{RunOnce: true}, feed)
+		if returnCode == 0 || err == nil {
+			t.Fatalf("%s: expected a failure, got %d %v", name, returnCode, err)
+		}
+	}
+}
+
+func TestCheckEnterpriseSupportSendsToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "reader" {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"Config": {"Version": "1.17.0"}}`)
+	}))
+	defer server.Close()
+
+	consulConfig := ConsulConfig{Addr: server.Listener.Addr().String(), Token: "reader", Namespace: "team"}
+	client, err := buildConsulClient(consulConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With the token the agent answers, and isn't an Enterprise one.
+	if err := checkEnterpriseSupport(client, consulConfig); err == nil {
+		t.Fatalf("Expected an OSS agent to be refused")
+	}
+}
+
+func TestCheckEnterpriseSupportErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	}))
+
+	consulConfig := ConsulConfig{Addr: server.Listener.Addr().String(), Namespace: "team"}
+	client, err := buildConsulClient(consulConfig)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A token that can't read the agent doesn't stop the watch.
+	if err := checkEnterpriseSupport(client, consulConfig); err != nil {
+		t.Fatalf("Expected a refused token to be tolerated, got %v", err)
+	}
+
+	// An agent that can't be reached does.
+	server.Close()
+	if err := checkEnterpriseSupport(client, consulConfig); err == nil {
+		t.Fatalf("Expected an error for an unreachable agent")
+	}
+}